@@ -0,0 +1,72 @@
+package hypercache
+
+import "sync/atomic"
+
+const (
+	accessBufferStripes = 16
+	accessStripeSize    = 64
+	// Stripes are drained once they are half full.
+	accessStripeDrainThreshold = accessStripeSize / 2
+)
+
+/*
+ * accessStripe is a bounded ring buffer of accessed entries. Any number of
+ * readers can record accesses concurrently without locking, and the entries
+ * are consumed by one goroutine holding the shard lock. Accesses are dropped
+ * when the stripe is full or when readers race for the same slot, as losing
+ * a few of them barely affects the eviction policy.
+ */
+type accessStripe struct {
+	// Number of accesses consumed from the stripe.
+	head atomic.Uint64
+	// Number of accesses recorded in the stripe.
+	tail    atomic.Uint64
+	entries [accessStripeSize]atomic.Pointer[cacheEntry]
+}
+
+// record adds an accessed entry to the stripe, and returns whether the
+// stripe should be drained.
+func (s *accessStripe) record(entry *cacheEntry) bool {
+	head, tail := s.head.Load(), s.tail.Load()
+	size := tail - head
+	if size >= accessStripeSize {
+		return true
+	}
+	if s.tail.CompareAndSwap(tail, tail+1) {
+		s.entries[tail%accessStripeSize].Store(entry)
+	}
+	return size+1 >= accessStripeDrainThreshold
+}
+
+// drain passes the recorded entries to apply. Only one goroutine may drain
+// the stripe at a time.
+func (s *accessStripe) drain(apply func(*cacheEntry)) {
+	head, tail := s.head.Load(), s.tail.Load()
+	for ; head < tail; head++ {
+		entry := s.entries[head%accessStripeSize].Swap(nil)
+		if entry == nil {
+			// The reader that claimed this slot hasn't stored its
+			// entry yet, pick it up on the next drain.
+			break
+		}
+		apply(entry)
+	}
+	s.head.Store(head)
+}
+
+// accessBuffer spreads accesses across stripes by key hash, so that readers
+// of different keys don't contend on the same stripe. The low bits of the
+// hash pick the shard, so the stripe is picked by the high bits.
+type accessBuffer struct {
+	stripes [accessBufferStripes]accessStripe
+}
+
+func (b *accessBuffer) record(hash uint64, entry *cacheEntry) bool {
+	return b.stripes[(hash>>32)%accessBufferStripes].record(entry)
+}
+
+func (b *accessBuffer) drain(apply func(*cacheEntry)) {
+	for i := range b.stripes {
+		b.stripes[i].drain(apply)
+	}
+}
@@ -0,0 +1,80 @@
+package hypercache
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestAccessStripeRecordAndDrain(t *testing.T) {
+	var stripe accessStripe
+	entries := make([]*cacheEntry, accessStripeSize+1)
+	for i := range entries {
+		entries[i] = &cacheEntry{}
+	}
+
+	for i, entry := range entries[:accessStripeDrainThreshold-1] {
+		if stripe.record(entry) {
+			t.Errorf("Should not ask for a drain after %d accesses", i+1)
+		}
+	}
+	for _, entry := range entries[accessStripeDrainThreshold-1:] {
+		if !stripe.record(entry) {
+			t.Errorf("Should ask for a drain once half full")
+		}
+	}
+
+	var drained []*cacheEntry
+	stripe.drain(func(entry *cacheEntry) {
+		drained = append(drained, entry)
+	})
+	// The access recorded while the stripe was full was dropped.
+	if len(drained) != accessStripeSize {
+		t.Fatalf("Should have drained %d accesses, got %d", accessStripeSize, len(drained))
+	}
+	for i, entry := range drained {
+		if entry != entries[i] {
+			t.Errorf("Should drain accesses in order")
+		}
+	}
+
+	stripe.drain(func(entry *cacheEntry) {
+		t.Errorf("Should not drain accesses twice")
+	})
+}
+
+func TestAccessBufferConcurrentRecord(t *testing.T) {
+	var buf accessBuffer
+	var mu sync.Mutex
+	recorded, drained := 0, 0
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			entry := &cacheEntry{}
+			for i := 0; i < 10000; i++ {
+				if buf.record(uint64(g+i)<<32, entry) && mu.TryLock() {
+					buf.drain(func(*cacheEntry) { drained++ })
+					mu.Unlock()
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	mu.Lock()
+	buf.drain(func(*cacheEntry) { drained++ })
+	for i := range buf.stripes {
+		stripe := &buf.stripes[i]
+		recorded += int(stripe.tail.Load())
+		if stripe.head.Load() != stripe.tail.Load() {
+			t.Errorf("Should have drained every recorded access")
+		}
+	}
+	mu.Unlock()
+
+	if drained != recorded {
+		t.Errorf("Drained %d accesses, recorded %d", drained, recorded)
+	}
+}
@@ -0,0 +1,121 @@
+package hypercache
+
+/*
+ * arcPolicy implements the Adaptive Replacement Cache. Entries seen once live
+ * in t1, and entries seen at least twice in t2. Keys recently evicted from
+ * them are remembered in the ghost lists b1 and b2. A hit in b1 means t1 was
+ * too small, and a hit in b2 means t2 was too small, so the target size of
+ * t1 adapts to the workload.
+ */
+type arcPolicy struct {
+	t1, t2, b1, b2 *keyList
+	capacity       int64
+	// Target size of t1.
+	target int64
+	// Key of the entry about to be added when the cache is full.
+	incoming string
+	// Key returned by the last call to Victim.
+	victim string
+}
+
+// NewARCPolicy creates an Adaptive Replacement Cache eviction policy, which
+// balances between recency and frequency depending on the workload.
+func NewARCPolicy(capacity int64) EvictionPolicy {
+	return &arcPolicy{
+		t1:       newKeyList(),
+		t2:       newKeyList(),
+		b1:       newKeyList(),
+		b2:       newKeyList(),
+		capacity: capacity,
+	}
+}
+
+func (p *arcPolicy) ShouldAddEntry(key string, value interface{}) bool {
+	p.incoming = key
+	return true
+}
+
+func (p *arcPolicy) ShouldKeepEntry(key string, value interface{}) bool {
+	if p.t1.remove(key) {
+		p.t2.pushFront(key)
+	} else if p.t2.contains(key) {
+		p.t2.moveToFront(key)
+	}
+	return true
+}
+
+func (p *arcPolicy) Resize(capacity int64) {
+	p.capacity = capacity
+	if p.target > capacity {
+		p.target = capacity
+	}
+}
+
+// adaptedTarget returns the target size of t1 after key is added.
+func (p *arcPolicy) adaptedTarget(key string) int64 {
+	target := p.target
+	if p.b1.contains(key) {
+		delta := int64(1)
+		if p.b2.len() > p.b1.len() {
+			delta = p.b2.len() / p.b1.len()
+		}
+		target += delta
+		if target > p.capacity {
+			target = p.capacity
+		}
+	} else if p.b2.contains(key) {
+		delta := int64(1)
+		if p.b1.len() > p.b2.len() {
+			delta = p.b1.len() / p.b2.len()
+		}
+		target -= delta
+		if target < 0 {
+			target = 0
+		}
+	}
+	return target
+}
+
+func (p *arcPolicy) EntryAdded(key string, value interface{}) {
+	p.target = p.adaptedTarget(key)
+	if p.b1.remove(key) || p.b2.remove(key) {
+		p.t2.pushFront(key)
+	} else {
+		p.t1.pushFront(key)
+	}
+	p.incoming = ""
+
+	// Forget the oldest ghosts once the directory exceeds its size.
+	for p.t1.len()+p.b1.len() > p.capacity && p.b1.len() > 0 {
+		p.b1.popBack()
+	}
+	for p.t1.len()+p.t2.len()+p.b1.len()+p.b2.len() > 2*p.capacity && p.b2.len() > 0 {
+		p.b2.popBack()
+	}
+}
+
+func (p *arcPolicy) EntryRemoved(key string) {
+	evicted := key == p.victim
+	p.victim = ""
+	// Only evicted entries are remembered as ghosts.
+	if p.t1.remove(key) {
+		if evicted {
+			p.b1.pushFront(key)
+		}
+	} else if p.t2.remove(key) {
+		if evicted {
+			p.b2.pushFront(key)
+		}
+	}
+}
+
+func (p *arcPolicy) Victim() (string, bool) {
+	target := p.adaptedTarget(p.incoming)
+	var ok bool
+	if p.t1.len() > 0 && (p.t1.len() > target || (p.b2.contains(p.incoming) && p.t1.len() == target)) {
+		p.victim, ok = p.t1.back()
+	} else if p.victim, ok = p.t2.back(); !ok {
+		p.victim, ok = p.t1.back()
+	}
+	return p.victim, ok
+}
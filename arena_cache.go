@@ -0,0 +1,553 @@
+package hypercache
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/maphash"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Size of the header preceding the key and value of arena entries:
+	// key hash, expiration and last update times, hash slot, key and
+	// value lengths, value kind, and expiration time of the redis key.
+	arenaHeaderSize = 41
+	// Number of entries evicted at a time when shrinking an arena shard.
+	arenaShrinkBatchSize = 256
+)
+
+// Kinds of values stored in arenas.
+const (
+	arenaBytesValue byte = iota
+	arenaStringValue
+	arenaRedisEntryValue
+)
+
+var (
+	ErrUnsupportedArenaValue = errors.New("cache: arena storage only holds serialized values")
+)
+
+type arenaHeader struct {
+	hash uint64
+	// Expiration time in nanoseconds since the epoch, or 0 if the entry
+	// doesn't expire.
+	expiresAt            int64
+	lastUpdatedTimestamp int64
+	keyHashSlot          uint16
+	keyLen               uint16
+	valueLen             uint32
+	kind                 byte
+	// Time the key of redis cache entries expires in redis, in
+	// nanoseconds since the epoch, or 0 if it doesn't.
+	keyExpiresAt int64
+}
+
+func (h *arenaHeader) size() uint32 {
+	return arenaHeaderSize + uint32(h.keyLen) + h.valueLen
+}
+
+func (h *arenaHeader) isExpired() bool {
+	return h.expiresAt != 0 && time.Now().UnixNano() > h.expiresAt
+}
+
+// remainingTTL returns the time until the entry expires, or 0 if it doesn't.
+func (h *arenaHeader) remainingTTL() time.Duration {
+	if h.expiresAt == 0 {
+		return 0
+	}
+	return time.Until(unixNanoTime(h.expiresAt))
+}
+
+func (h *arenaHeader) encode(buff *[arenaHeaderSize]byte) {
+	binary.BigEndian.PutUint64(buff[0:8], h.hash)
+	binary.BigEndian.PutUint64(buff[8:16], uint64(h.expiresAt))
+	binary.BigEndian.PutUint64(buff[16:24], uint64(h.lastUpdatedTimestamp))
+	binary.BigEndian.PutUint16(buff[24:26], h.keyHashSlot)
+	binary.BigEndian.PutUint16(buff[26:28], h.keyLen)
+	binary.BigEndian.PutUint32(buff[28:32], h.valueLen)
+	buff[32] = h.kind
+	binary.BigEndian.PutUint64(buff[33:41], uint64(h.keyExpiresAt))
+}
+
+func (h *arenaHeader) decode(buff *[arenaHeaderSize]byte) {
+	h.hash = binary.BigEndian.Uint64(buff[0:8])
+	h.expiresAt = int64(binary.BigEndian.Uint64(buff[8:16]))
+	h.lastUpdatedTimestamp = int64(binary.BigEndian.Uint64(buff[16:24]))
+	h.keyHashSlot = binary.BigEndian.Uint16(buff[24:26])
+	h.keyLen = binary.BigEndian.Uint16(buff[26:28])
+	h.valueLen = binary.BigEndian.Uint32(buff[28:32])
+	h.kind = buff[32]
+	h.keyExpiresAt = int64(binary.BigEndian.Uint64(buff[33:41]))
+}
+
+/*
+ * arenaCache is an in-memory cache storing entries in large pre-allocated
+ * ring buffers, indexed by maps holding no pointers. The garbage collector
+ * therefore doesn't scan the entries, however many there are. Entries are
+ * evicted in insertion order once a buffer is full or holds the maximum
+ * number of entries, and eviction policies don't apply.
+ *
+ * Only serialized values can be stored: byte slices, strings and redis
+ * cache entries. Values are copied out of the buffers on every Get.
+ */
+type arenaCache struct {
+	shards []*arenaShard
+	// Used to hash keys to their shard and index.
+	seed maphash.Seed
+	// This is the maximum number of entries we'll store in the cache.
+	maxEntries *atomic.Int64
+	// Serializes calls to Resize.
+	resizeMu sync.Mutex
+	// Evicts entries in the background when the capacity is lowered.
+	shrinker *shrinker
+}
+
+func newArenaCache(maxEntries int64, opts ...Option) *arenaCache {
+	o := newOptions(opts)
+	numShards := nextPowerOfTwo(uint64(o.shards))
+	if o.shards <= 0 {
+		numShards = defaultShardCount(maxEntries)
+	}
+	shardSize := o.arenaSize / int64(numShards)
+	if shardSize > math.MaxUint32 {
+		panic("cache: arena shards can't exceed 4GB, use more shards")
+	}
+	shardEntries := (maxEntries + int64(numShards) - 1) / int64(numShards)
+
+	ac := &arenaCache{
+		shards:     make([]*arenaShard, numShards),
+		seed:       maphash.MakeSeed(),
+		maxEntries: &atomic.Int64{},
+	}
+	ac.shrinker = newShrinker(func(stop <-chan struct{}) {
+		for _, shard := range ac.shards {
+			shard.shrink(stop)
+		}
+	})
+	for i := range ac.shards {
+		ac.shards[i] = &arenaShard{
+			index:      map[uint64]uint32{},
+			buf:        make([]byte, shardSize),
+			maxEntries: shardEntries,
+			onRemoval:  o.onRemoval,
+		}
+	}
+	ac.maxEntries.Store(maxEntries)
+	return ac
+}
+
+func (ac *arenaCache) shardFor(key string) (*arenaShard, uint64) {
+	hash := maphash.String(ac.seed, key)
+	return ac.shards[hash&uint64(len(ac.shards)-1)], hash
+}
+
+func (ac *arenaCache) Get(key string) (interface{}, bool) {
+	shard, hash := ac.shardFor(key)
+	return shard.get(hash, key)
+}
+
+// getWithTTL returns the value of the key and the time until it expires, or
+// 0 if it doesn't.
+func (ac *arenaCache) getWithTTL(key string) (interface{}, time.Duration, bool) {
+	shard, hash := ac.shardFor(key)
+	return shard.getWithTTL(hash, key)
+}
+
+// setExpiry changes when the entry of the key expires without changing its
+// value, or makes it never expire if expiresAt is the zero time. Redis cache
+// entries are also told when their key expires in redis. It returns false if
+// the key isn't cached.
+func (ac *arenaCache) setExpiry(key string, expiresAt, keyExpiresAt time.Time) bool {
+	shard, hash := ac.shardFor(key)
+	return shard.setExpiry(hash, key, expiresAt, keyExpiresAt)
+}
+
+func (ac *arenaCache) Set(key string, value interface{}, ttl time.Duration) error {
+	shard, hash := ac.shardFor(key)
+	return shard.set(hash, key, value, ttl)
+}
+
+func (ac *arenaCache) Delete(key string) {
+	shard, hash := ac.shardFor(key)
+	shard.remove(hash, key, nil, RemovalDeleted)
+}
+
+// invalidate removes the entry of the key if it was last updated at the
+// same time as the given redis cache entry.
+func (ac *arenaCache) invalidate(key string, value interface{}) {
+	stale, ok := value.(*redisCacheEntry)
+	if !ok {
+		return
+	}
+	shard, hash := ac.shardFor(key)
+	shard.remove(hash, key, func(h *arenaHeader) bool {
+		return h.lastUpdatedTimestamp == stale.lastUpdatedTimestamp
+	}, RemovalInvalidated)
+}
+
+// Inspect returns the metadata of the entry of the key. Arenas don't track
+// when entries were created or accessed, and the update time is the one of
+// redis cache entries.
+func (ac *arenaCache) Inspect(key string) (EntryInfo, bool) {
+	info, _, ok := ac.inspect(key)
+	return info, ok
+}
+
+// inspect returns the metadata and a copy of the value of the entry of the
+// key.
+func (ac *arenaCache) inspect(key string) (EntryInfo, interface{}, bool) {
+	shard, hash := ac.shardFor(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	h, off, ok := shard.lookup(hash, key)
+	if !ok || h.isExpired() {
+		return EntryInfo{}, nil, false
+	}
+	info := EntryInfo{
+		Slot: h.keyHashSlot,
+		Cost: int64(h.size()),
+	}
+	if h.lastUpdatedTimestamp != 0 {
+		info.Updated = time.UnixMicro(h.lastUpdatedTimestamp)
+	}
+	info.TTL = h.remainingTTL()
+	return info, shard.value(&h, off), true
+}
+
+// Len returns the number of entries in the cache.
+func (ac *arenaCache) Len() int64 {
+	var n int64
+	for _, shard := range ac.shards {
+		shard.mu.RLock()
+		n += int64(len(shard.index))
+		shard.mu.RUnlock()
+	}
+	return n
+}
+
+// Resize changes the maximum number of entries of the cache. When it
+// shrinks, the oldest entries are evicted down to the new size in the
+// background, or before Resize returns once the cache is closed.
+func (ac *arenaCache) Resize(maxEntries int64) error {
+	if maxEntries <= 0 {
+		return ErrInvalidCapacity
+	}
+	ac.resizeMu.Lock()
+	defer ac.resizeMu.Unlock()
+
+	numShards := int64(len(ac.shards))
+	shardEntries := (maxEntries + numShards - 1) / numShards
+	ac.maxEntries.Store(maxEntries)
+	overfull := false
+	for _, shard := range ac.shards {
+		shard.mu.Lock()
+		shard.maxEntries = shardEntries
+		if int64(len(shard.index)) > shardEntries {
+			overfull = true
+		}
+		shard.mu.Unlock()
+	}
+	if overfull {
+		ac.shrinker.request()
+	}
+	return nil
+}
+
+// Capacity returns the maximum number of entries of the cache.
+func (ac *arenaCache) Capacity() int64 {
+	return ac.maxEntries.Load()
+}
+
+// Close stops the goroutine evicting entries after the capacity was lowered,
+// if any, and waits for it to return. The cache can still be used
+// afterwards.
+func (ac *arenaCache) Close() {
+	ac.shrinker.close()
+}
+
+// arenaShard holds the entries of the keys assigned to one shard of an
+// arenaCache in a ring buffer.
+type arenaShard struct {
+	mu sync.RWMutex
+	// Offset in the buffer of the entry of every key hash.
+	index map[uint64]uint32
+	buf   []byte
+	// Offsets of the oldest entry and of the next one.
+	head, tail uint32
+	// Number of bytes between head and tail, including those of entries
+	// that are no longer indexed.
+	used uint32
+	// This is the maximum number of entries we'll store in the shard.
+	maxEntries int64
+	// Called with the entries removed from the shard, or nil.
+	onRemoval RemovalListener
+	// Entries removed while mu was held, reported once it's released.
+	removed []arenaRemoval
+}
+
+type arenaRemoval struct {
+	key    string
+	value  interface{}
+	reason RemovalReason
+}
+
+// wrap returns the offset n bytes after off in the buffer.
+func (s *arenaShard) wrap(off, n uint32) uint32 {
+	return uint32((uint64(off) + uint64(n)) % uint64(len(s.buf)))
+}
+
+// write copies data to the buffer at the given offset, wrapping around its
+// end, and returns the offset following it.
+func (s *arenaShard) write(off uint32, data []byte) uint32 {
+	n := copy(s.buf[off:], data)
+	copy(s.buf, data[n:])
+	return s.wrap(off, uint32(len(data)))
+}
+
+// read copies len(dst) bytes from the buffer at the given offset, wrapping
+// around its end, and returns the offset following them.
+func (s *arenaShard) read(off uint32, dst []byte) uint32 {
+	n := copy(dst, s.buf[off:])
+	copy(dst[n:], s.buf)
+	return s.wrap(off, uint32(len(dst)))
+}
+
+// readHeader decodes the header of the entry at the given offset, and
+// returns the offset of its key.
+func (s *arenaShard) readHeader(off uint32, h *arenaHeader) uint32 {
+	var buff [arenaHeaderSize]byte
+	off = s.read(off, buff[:])
+	h.decode(&buff)
+	return off
+}
+
+// keyEquals reports whether the key stored at the given offset is key.
+func (s *arenaShard) keyEquals(off uint32, key string) bool {
+	end := uint64(off) + uint64(len(key))
+	if end <= uint64(len(s.buf)) {
+		return string(s.buf[off:end]) == key
+	}
+	n := uint32(len(s.buf)) - off
+	return string(s.buf[off:]) == key[:n] && string(s.buf[:len(key)-int(n)]) == key[n:]
+}
+
+// lookup returns the header of the entry of the key and the offset of its
+// value. s.mu must be held.
+func (s *arenaShard) lookup(hash uint64, key string) (arenaHeader, uint32, bool) {
+	var h arenaHeader
+	off, ok := s.index[hash]
+	if !ok {
+		return h, 0, false
+	}
+	keyOff := s.readHeader(off, &h)
+	if int(h.keyLen) != len(key) || !s.keyEquals(keyOff, key) {
+		// Another key with the same hash.
+		return h, 0, false
+	}
+	return h, s.wrap(keyOff, uint32(h.keyLen)), true
+}
+
+// value copies the value of the entry out of the buffer. s.mu must be held.
+func (s *arenaShard) value(h *arenaHeader, off uint32) interface{} {
+	data := make([]byte, h.valueLen)
+	s.read(off, data)
+	switch h.kind {
+	case arenaStringValue:
+		return string(data)
+	case arenaRedisEntryValue:
+		return &redisCacheEntry{
+			value:                data,
+			lastUpdatedTimestamp: h.lastUpdatedTimestamp,
+			keyHashSlot:          h.keyHashSlot,
+			expiresAt:            h.keyExpiresAt,
+		}
+	}
+	return data
+}
+
+func (s *arenaShard) get(hash uint64, key string) (interface{}, bool) {
+	value, _, ok := s.getWithTTL(hash, key)
+	return value, ok
+}
+
+func (s *arenaShard) getWithTTL(hash uint64, key string) (interface{}, time.Duration, bool) {
+	s.mu.RLock()
+	h, off, ok := s.lookup(hash, key)
+	if !ok {
+		s.mu.RUnlock()
+		return nil, 0, false
+	}
+	if h.isExpired() {
+		s.mu.RUnlock()
+		s.remove(hash, key, (*arenaHeader).isExpired, RemovalExpired)
+		return nil, 0, false
+	}
+	value := s.value(&h, off)
+	s.mu.RUnlock()
+	return value, h.remainingTTL(), true
+}
+
+func (s *arenaShard) setExpiry(hash uint64, key string, expiresAt, keyExpiresAt time.Time) bool {
+	s.mu.Lock()
+	defer s.unlock()
+	h, valueOff, ok := s.lookup(hash, key)
+	if !ok {
+		return false
+	}
+	if h.isExpired() || (!expiresAt.IsZero() && !expiresAt.After(time.Now())) {
+		s.unindex(hash, key, &h, valueOff, RemovalExpired)
+		return !h.isExpired()
+	}
+	h.expiresAt = unixNano(expiresAt)
+	if h.kind == arenaRedisEntryValue {
+		h.keyExpiresAt = unixNano(keyExpiresAt)
+	}
+	// Rewrite the header in place, the key and value don't move.
+	var buff [arenaHeaderSize]byte
+	h.encode(&buff)
+	s.write(s.index[hash], buff[:])
+	return true
+}
+
+func (s *arenaShard) set(hash uint64, key string, value interface{}, ttl time.Duration) error {
+	h := arenaHeader{hash: hash}
+	var data []byte
+	switch value := value.(type) {
+	case []byte:
+		h.kind, data = arenaBytesValue, value
+	case string:
+		h.kind, data = arenaStringValue, []byte(value)
+	case *redisCacheEntry:
+		serialized, ok := value.value.([]byte)
+		if !ok {
+			return ErrUnsupportedArenaValue
+		}
+		h.kind, data = arenaRedisEntryValue, serialized
+		h.lastUpdatedTimestamp = value.lastUpdatedTimestamp
+		h.keyHashSlot = value.keyHashSlot
+		h.keyExpiresAt = value.expiresAt
+	default:
+		return ErrUnsupportedArenaValue
+	}
+	if ttl > 0 {
+		h.expiresAt = time.Now().Add(ttl).UnixNano()
+	}
+
+	s.mu.Lock()
+	defer s.unlock()
+	fits := len(key) <= math.MaxUint16 && uint64(arenaHeaderSize+len(key)+len(data)) <= uint64(len(s.buf))
+	if fits {
+		h.keyLen = uint16(len(key))
+		h.valueLen = uint32(len(data))
+	}
+
+	if old, valueOff, ok := s.lookup(hash, key); ok {
+		s.unindex(hash, key, &old, valueOff, RemovalReplaced)
+	} else if off, ok := s.index[hash]; ok {
+		// The new key takes over the hash of another one.
+		s.unindexAt(off, RemovalEvicted)
+	}
+	if !fits {
+		// Entries larger than the buffer are not stored.
+		return nil
+	}
+
+	size := h.size()
+	for s.used > 0 && (uint64(s.used)+uint64(size) > uint64(len(s.buf)) || int64(len(s.index)) >= s.maxEntries) {
+		s.evictOldest()
+	}
+	if s.used == 0 {
+		// Keep entries from wrapping around when the buffer is empty.
+		s.head, s.tail = 0, 0
+	}
+
+	var buff [arenaHeaderSize]byte
+	h.encode(&buff)
+	s.index[hash] = s.tail
+	off := s.write(s.tail, buff[:])
+	off = s.write(off, []byte(key))
+	s.tail = s.write(off, data)
+	s.used += size
+	return nil
+}
+
+// remove removes the entry of the key if it matches, or unconditionally if
+// match is nil.
+func (s *arenaShard) remove(hash uint64, key string, match func(*arenaHeader) bool, reason RemovalReason) {
+	s.mu.Lock()
+	defer s.unlock()
+	h, off, ok := s.lookup(hash, key)
+	if ok && (match == nil || match(&h)) {
+		s.unindex(hash, key, &h, off, reason)
+	}
+}
+
+// unindex removes the entry from the index. Its bytes are reclaimed once it
+// becomes the oldest entry. s.mu must be held.
+func (s *arenaShard) unindex(hash uint64, key string, h *arenaHeader, valueOff uint32, reason RemovalReason) {
+	delete(s.index, hash)
+	if s.onRemoval != nil {
+		s.removed = append(s.removed, arenaRemoval{key, s.value(h, valueOff), reason})
+	}
+}
+
+// unindexAt removes the entry at the given offset from the index. s.mu must
+// be held.
+func (s *arenaShard) unindexAt(off uint32, reason RemovalReason) {
+	var h arenaHeader
+	keyOff := s.readHeader(off, &h)
+	var key string
+	if s.onRemoval != nil {
+		buff := make([]byte, h.keyLen)
+		s.read(keyOff, buff)
+		key = string(buff)
+	}
+	s.unindex(h.hash, key, &h, s.wrap(keyOff, uint32(h.keyLen)), reason)
+}
+
+// evictOldest reclaims the bytes of the oldest entry, removing it from the
+// index if it's still there. s.mu must be held.
+func (s *arenaShard) evictOldest() {
+	var h arenaHeader
+	s.readHeader(s.head, &h)
+	if off, ok := s.index[h.hash]; ok && off == s.head {
+		s.unindexAt(s.head, RemovalEvicted)
+	}
+	s.head = s.wrap(s.head, h.size())
+	s.used -= h.size()
+}
+
+// shrink evicts the oldest entries until the shard fits its maximum number
+// of entries, releasing the lock between batches. It returns early once stop
+// is closed.
+func (s *arenaShard) shrink(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		s.mu.Lock()
+		for i := 0; i < arenaShrinkBatchSize && s.used > 0 && int64(len(s.index)) > s.maxEntries; i++ {
+			s.evictOldest()
+		}
+		done := s.used == 0 || int64(len(s.index)) <= s.maxEntries
+		s.unlock()
+		if done {
+			return
+		}
+	}
+}
+
+// unlock releases s.mu, then reports the entries removed while it was held.
+func (s *arenaShard) unlock() {
+	removed := s.removed
+	s.removed = nil
+	s.mu.Unlock()
+	for _, r := range removed {
+		s.onRemoval(r.key, r.value, r.reason)
+	}
+}
@@ -0,0 +1,289 @@
+package hypercache
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func newTestArenaCache(maxEntries, size int64, opts ...Option) *arenaCache {
+	return newArenaCache(maxEntries, append([]Option{WithShards(1), WithArenaStorage(size)}, opts...)...)
+}
+
+func TestArenaCacheSetAndGet(t *testing.T) {
+	cache := newTestArenaCache(10, 1024)
+
+	cache.Set("bytes", []byte("v1"), 0)
+	cache.Set("string", "v2", 0)
+	cache.Set("entry", &redisCacheEntry{value: []byte("v3"), lastUpdatedTimestamp: 42, keyHashSlot: 7}, 0)
+
+	if val, ok := cache.Get("bytes"); !ok || !bytes.Equal(val.([]byte), []byte("v1")) {
+		t.Errorf("Failed to get byte slice, got %v", val)
+	}
+	if val, ok := cache.Get("string"); !ok || val != "v2" {
+		t.Errorf("Failed to get string, got %v", val)
+	}
+	val, ok := cache.Get("entry")
+	entry, _ := val.(*redisCacheEntry)
+	if !ok || entry == nil || !bytes.Equal(entry.value.([]byte), []byte("v3")) || entry.lastUpdatedTimestamp != 42 || entry.keyHashSlot != 7 {
+		t.Errorf("Failed to get redis cache entry, got %v", val)
+	}
+	if _, ok := cache.Get("missing"); ok {
+		t.Errorf("Should not get missing key")
+	}
+	if err := cache.Set("struct", testStruct{}, 0); err != ErrUnsupportedArenaValue {
+		t.Errorf("Should refuse values that aren't serialized, got %v", err)
+	}
+	if cache.Len() != 3 {
+		t.Errorf("Should hold 3 entries, has %d", cache.Len())
+	}
+}
+
+func TestArenaCacheReplaceAndDelete(t *testing.T) {
+	cache := newTestArenaCache(10, 1024)
+
+	cache.Set("k1", "v1", 0)
+	cache.Set("k1", "longer value", 0)
+	if val, ok := cache.Get("k1"); !ok || val != "longer value" {
+		t.Errorf("Failed to replace value, got %v", val)
+	}
+
+	cache.Delete("k1")
+	if _, ok := cache.Get("k1"); ok {
+		t.Errorf("Failed to delete entry")
+	}
+	if cache.Len() != 0 {
+		t.Errorf("Should be empty, has %d entries", cache.Len())
+	}
+}
+
+func TestArenaCacheExpiry(t *testing.T) {
+	cache := newTestArenaCache(10, 1024)
+
+	cache.Set("k1", "v1", 10*time.Millisecond)
+	cache.Set("k2", "v2", 0)
+	time.Sleep(20 * time.Millisecond)
+
+	if _, ok := cache.Get("k1"); ok {
+		t.Errorf("Should not get expired entry")
+	}
+	if _, ok := cache.Get("k2"); !ok {
+		t.Errorf("Failed to get entry without TTL")
+	}
+	if cache.Len() != 1 {
+		t.Errorf("Should have removed expired entry")
+	}
+}
+
+func TestArenaCacheEvictsOldestWhenFull(t *testing.T) {
+	// Entries take 41 bytes of header, 3 of key and 10 of value, so the
+	// buffer holds 4 of them and entries wrap around its end.
+	cache := newTestArenaCache(100, 240)
+
+	for i := 0; i < 50; i++ {
+		cache.Set(fmt.Sprintf("k%02d", i), fmt.Sprintf("%010d", i), 0)
+	}
+
+	if cache.Len() != 4 {
+		t.Errorf("Should hold 4 entries, has %d", cache.Len())
+	}
+	for i := 46; i < 50; i++ {
+		val, ok := cache.Get(fmt.Sprintf("k%02d", i))
+		if !ok || val != fmt.Sprintf("%010d", i) {
+			t.Errorf("Failed to get entry %d, got %v", i, val)
+		}
+	}
+}
+
+func TestArenaCacheEvictsOldestAtMaxEntries(t *testing.T) {
+	cache := newTestArenaCache(3, 1024)
+
+	for i := 0; i < 5; i++ {
+		cache.Set(fmt.Sprintf("%d", i), "v", 0)
+	}
+
+	if cache.Len() != 3 {
+		t.Errorf("Should hold 3 entries, has %d", cache.Len())
+	}
+	for i := 0; i < 2; i++ {
+		if _, ok := cache.Get(fmt.Sprintf("%d", i)); ok {
+			t.Errorf("Should have evicted entry %d", i)
+		}
+	}
+}
+
+func TestArenaCacheRefusesLargeEntries(t *testing.T) {
+	cache := newTestArenaCache(10, 64)
+
+	cache.Set("k1", "v1", 0)
+	cache.Set("k1", string(make([]byte, 64)), 0)
+
+	if _, ok := cache.Get("k1"); ok {
+		t.Errorf("Should not store entries larger than the buffer")
+	}
+}
+
+func TestArenaCacheInspect(t *testing.T) {
+	cache := newTestArenaCache(10, 1024)
+	timestamp := time.Now().UnixMicro()
+	cache.Set("k1", &redisCacheEntry{value: []byte("v1"), lastUpdatedTimestamp: timestamp, keyHashSlot: 12}, time.Hour)
+
+	info, ok := cache.Inspect("k1")
+	if !ok {
+		t.Fatalf("Failed to inspect entry")
+	}
+	if info.Updated.UnixMicro() != timestamp || info.Slot != 12 || info.Cost != arenaHeaderSize+4 {
+		t.Errorf("Should report update time, slot and cost, got %v", info)
+	}
+	if info.TTL <= 59*time.Minute || info.TTL > time.Hour {
+		t.Errorf("Should report TTL remaining, got %v", info.TTL)
+	}
+}
+
+func TestArenaCacheSetExpiry(t *testing.T) {
+	cache := newTestArenaCache(10, 1024)
+	cache.Set("k1", "v1", time.Hour)
+
+	if !cache.setExpiry("k1", time.Now().Add(time.Minute), time.Time{}) {
+		t.Fatalf("Failed to set expiry")
+	}
+	value, ttl, ok := cache.getWithTTL("k1")
+	if !ok || value != "v1" || ttl <= 59*time.Second || ttl > time.Minute {
+		t.Errorf("Should keep value with the new TTL, got %v and %v", value, ttl)
+	}
+
+	cache.setExpiry("k1", time.Time{}, time.Time{})
+	if _, ttl, _ := cache.getWithTTL("k1"); ttl != 0 {
+		t.Errorf("Should make the entry never expire, got %v", ttl)
+	}
+
+	cache.setExpiry("k1", time.Now().Add(-time.Second), time.Time{})
+	if _, ok := cache.Get("k1"); ok || cache.Len() != 0 {
+		t.Errorf("Should remove entries expiring in the past")
+	}
+
+	// Redis cache entries are told when their key expires in redis.
+	keyExpiresAt := time.Now().Add(time.Hour)
+	cache.Set("entry", &redisCacheEntry{value: []byte("v"), expiresAt: time.Now().Add(time.Minute).UnixNano()}, time.Minute)
+	cache.setExpiry("entry", time.Now().Add(time.Second), keyExpiresAt)
+	if value, _ := cache.Get("entry"); value.(*redisCacheEntry).expiresAt != keyExpiresAt.UnixNano() {
+		t.Errorf("Should change when the key expires in redis, got %v", value.(*redisCacheEntry).expiresAt)
+	}
+}
+
+func TestArenaCacheHashCollision(t *testing.T) {
+	cache := newTestArenaCache(10, 1024)
+	shard := cache.shards[0]
+
+	shard.set(1, "k1", "v1", 0)
+	if _, ok := shard.get(1, "k2"); ok {
+		t.Errorf("Should not get another key with the same hash")
+	}
+
+	shard.set(1, "k2", "v2", 0)
+	if _, ok := shard.get(1, "k1"); ok {
+		t.Errorf("Should have evicted the key with the same hash")
+	}
+	if val, ok := shard.get(1, "k2"); !ok || val != "v2" {
+		t.Errorf("Failed to get entry, got %v", val)
+	}
+}
+
+func TestArenaCacheResize(t *testing.T) {
+	cache := newTestArenaCache(100, 1<<16)
+	for i := 0; i < 100; i++ {
+		cache.Set(fmt.Sprintf("%d", i), "v", 0)
+	}
+
+	if err := cache.Resize(10); err != nil {
+		t.Fatalf("Failed to resize: %v", err)
+	}
+	for i := 0; i < 100 && cache.Len() > 10; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if cache.Len() != 10 || cache.Capacity() != 10 {
+		t.Errorf("Should have evicted down to 10 entries, has %d", cache.Len())
+	}
+	if _, ok := cache.Get("99"); !ok {
+		t.Errorf("Should have kept the newest entries")
+	}
+}
+
+func TestArenaCacheCloseWaitsForShrinks(t *testing.T) {
+	cache := newTestArenaCache(100000, 1<<24, WithShards(4))
+	for i := 0; i < 100000; i++ {
+		cache.Set(fmt.Sprintf("%d", i), "v", 0)
+	}
+	for _, capacity := range []int64{50000, 10000, 100} {
+		cache.Resize(capacity)
+	}
+	cache.Close()
+
+	// No shrink runs once Close returned.
+	n := cache.Len()
+	time.Sleep(10 * time.Millisecond)
+	if cache.Len() != n {
+		t.Errorf("Should not evict entries after Close, had %d entries, has %d", n, cache.Len())
+	}
+
+	// Resizing a closed cache evicts entries right away.
+	cache.Resize(20)
+	if cache.Len() > 20 {
+		t.Errorf("Should have evicted down to 20 entries, has %d", cache.Len())
+	}
+}
+
+func TestArenaCacheOnRemoval(t *testing.T) {
+	recorder := &removalRecorder{removals: map[string]RemovalReason{}}
+	cache := newTestArenaCache(3, 1024, WithOnRemoval(recorder.listener))
+
+	cache.Set("evicted", "v", 0)
+	cache.Set("expired", "v", time.Millisecond)
+	cache.Set("deleted", "v", 0)
+	cache.Set("replaced", "v", 0)
+	cache.Set("replaced", "v", 0)
+	time.Sleep(5 * time.Millisecond)
+	cache.Get("expired")
+	cache.Delete("deleted")
+
+	expected := map[string]RemovalReason{
+		"evicted":  RemovalEvicted,
+		"expired":  RemovalExpired,
+		"deleted":  RemovalDeleted,
+		"replaced": RemovalReplaced,
+	}
+	for key, want := range expected {
+		if reason, ok := recorder.reason(key); !ok || reason != want {
+			t.Errorf("%s: should have been removed as %v, got %v", key, want, reason)
+		}
+	}
+}
+
+// Reports how long a full garbage collection takes with a million entries
+// stored as objects or in arenas.
+func BenchmarkL1GC(b *testing.B) {
+	const entries = 1000000
+	caches := map[string]func() localCache{
+		"objects": func() localCache { return newMemoryCache(entries) },
+		"arena":   func() localCache { return newArenaCache(entries, WithArenaStorage(128<<20)) },
+	}
+	for name, newCache := range caches {
+		b.Run(name, func(b *testing.B) {
+			cache := newCache()
+			value := make([]byte, 64)
+			for i := 0; i < entries; i++ {
+				cache.Set(fmt.Sprintf("%d", i), &redisCacheEntry{value: value}, 0)
+			}
+
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+			}
+			b.ReportMetric(float64(time.Since(start).Milliseconds())/float64(b.N), "ms/gc")
+			runtime.KeepAlive(cache)
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package hypercache
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// Checksum is the algorithm used to verify the integrity of stored values.
+type Checksum uint8
+
+const (
+	NoChecksum Checksum = iota
+	CRC32CChecksum
+	CRC16Checksum
+)
+
+// The checksum algorithm of a value is stored in its envelope flags, right
+// above the compression algorithm.
+const (
+	envelopeChecksumMask  byte = 0x18
+	envelopeChecksumShift      = 3
+)
+
+var (
+	ErrChecksumMismatch = errors.New("cache: value checksum mismatch")
+
+	crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+func (c Checksum) flags() byte {
+	return byte(c) << envelopeChecksumShift
+}
+
+func checksumFromFlags(flags byte) Checksum {
+	return Checksum((flags & envelopeChecksumMask) >> envelopeChecksumShift)
+}
+
+// size returns the number of bytes the checksum takes at the end of a value.
+func (c Checksum) size() int {
+	switch c {
+	case CRC32CChecksum:
+		return 4
+	case CRC16Checksum:
+		return 2
+	}
+	return 0
+}
+
+// appendTo appends the checksum of buff to it.
+func (c Checksum) appendTo(buff []byte) []byte {
+	switch c {
+	case CRC32CChecksum:
+		return binary.BigEndian.AppendUint32(buff, crc32.Checksum(buff, crc32cTable))
+	case CRC16Checksum:
+		return binary.BigEndian.AppendUint16(buff, crc16CCITT(buff))
+	}
+	return buff
+}
+
+// verify checks the checksum at the end of buff and returns buff without it.
+func (c Checksum) verify(buff []byte) ([]byte, error) {
+	if len(buff) < c.size() {
+		return nil, ErrChecksumMismatch
+	}
+	data, sum := buff[:len(buff)-c.size()], buff[len(buff)-c.size():]
+	switch c {
+	case NoChecksum:
+		return buff, nil
+	case CRC32CChecksum:
+		if binary.BigEndian.Uint32(sum) != crc32.Checksum(data, crc32cTable) {
+			return nil, ErrChecksumMismatch
+		}
+	case CRC16Checksum:
+		if binary.BigEndian.Uint16(sum) != crc16CCITT(data) {
+			return nil, ErrChecksumMismatch
+		}
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+	return data, nil
+}
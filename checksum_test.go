@@ -0,0 +1,45 @@
+package hypercache
+
+import (
+	"testing"
+)
+
+func TestChecksumRoundTrip(t *testing.T) {
+	for _, checksum := range []Checksum{CRC32CChecksum, CRC16Checksum} {
+		s := newDefaultSerde(MsgpackCodec{}, newOptions([]Option{WithChecksum(checksum)}), &cacheStats{})
+		buff, err := s.serialize("k1", testStruct{Name: "v1", Age: 22})
+		if err != nil {
+			t.Fatalf("Failed to serialize with checksum %d: %v", checksum, err)
+		}
+
+		var val testStruct
+		if err := s.deserialize("k1", buff, &val); err != nil {
+			t.Fatalf("Failed to deserialize with checksum %d: %v", checksum, err)
+		}
+		if val.Name != "v1" || val.Age != 22 {
+			t.Errorf("Failed to round trip value with checksum %d", checksum)
+		}
+	}
+}
+
+func TestChecksumDetectsCorruption(t *testing.T) {
+	for _, checksum := range []Checksum{CRC32CChecksum, CRC16Checksum} {
+		s := newDefaultSerde(MsgpackCodec{}, newOptions([]Option{WithChecksum(checksum)}), &cacheStats{})
+		buff, err := s.serialize("k1", testStruct{Name: "v1", Age: 22})
+		if err != nil {
+			t.Fatalf("Failed to serialize with checksum %d: %v", checksum, err)
+		}
+
+		corrupted := append([]byte{}, buff...)
+		corrupted[envelopeHeaderSize+1] ^= 0xFF
+		var val testStruct
+		if err := s.deserialize("k1", corrupted, &val); err != ErrChecksumMismatch {
+			t.Errorf("Should have failed with ErrChecksumMismatch, got %v", err)
+		}
+
+		truncated := buff[:len(buff)-3]
+		if err := s.deserialize("k1", truncated, &val); err != ErrChecksumMismatch {
+			t.Errorf("Should have failed to read truncated value with ErrChecksumMismatch, got %v", err)
+		}
+	}
+}
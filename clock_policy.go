@@ -0,0 +1,87 @@
+package hypercache
+
+type clockSlot struct {
+	key        string
+	referenced bool
+	used       bool
+}
+
+/*
+ * clockPolicy implements the CLOCK algorithm, an approximation of LRU that
+ * doesn't reorder anything on access. Entries sit in a circular buffer and
+ * are flagged when accessed. To find a victim, the clock hand sweeps the
+ * buffer, clearing flags, until it reaches an entry that isn't flagged.
+ */
+type clockPolicy struct {
+	slots []clockSlot
+	// Slot of every key.
+	index map[string]int
+	// Slots not holding any key.
+	free []int
+	hand int
+}
+
+// NewClockPolicy creates a CLOCK eviction policy, which approximates LRU
+// at a lower cost per access.
+func NewClockPolicy(capacity int64) EvictionPolicy {
+	return &clockPolicy{
+		slots: make([]clockSlot, 0, capacity),
+		index: map[string]int{},
+	}
+}
+
+func (p *clockPolicy) ShouldAddEntry(key string, value interface{}) bool {
+	return true
+}
+
+func (p *clockPolicy) ShouldKeepEntry(key string, value interface{}) bool {
+	if i, ok := p.index[key]; ok {
+		p.slots[i].referenced = true
+	}
+	return true
+}
+
+func (p *clockPolicy) EntryAdded(key string, value interface{}) {
+	slot := clockSlot{key: key, used: true}
+	if n := len(p.free); n > 0 {
+		i := p.free[n-1]
+		p.free = p.free[:n-1]
+		p.slots[i] = slot
+		p.index[key] = i
+		return
+	}
+	p.slots = append(p.slots, slot)
+	p.index[key] = len(p.slots) - 1
+}
+
+func (p *clockPolicy) EntryRemoved(key string) {
+	i, ok := p.index[key]
+	if !ok {
+		return
+	}
+	p.slots[i] = clockSlot{}
+	p.free = append(p.free, i)
+	delete(p.index, key)
+}
+
+func (p *clockPolicy) Victim() (string, bool) {
+	if len(p.index) == 0 {
+		return "", false
+	}
+	for {
+		if p.hand >= len(p.slots) {
+			p.hand = 0
+		}
+		slot := &p.slots[p.hand]
+		p.hand++
+		if !slot.used {
+			continue
+		}
+		if slot.referenced {
+			// Give the entry a second chance.
+			slot.referenced = false
+			continue
+		}
+		return slot.key, true
+	}
+}
@@ -0,0 +1,77 @@
+package hypercache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec converts values to and from the bytes stored in redis.
+type Codec interface {
+	// Marshal encodes the given value.
+	Marshal(value interface{}) ([]byte, error)
+	// Unmarshal decodes data into value, which must be a pointer.
+	Unmarshal(data []byte, value interface{}) error
+}
+
+// MsgpackCodec encodes values using msgpack. This is the default codec.
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) Marshal(value interface{}) ([]byte, error) {
+	return msgpack.Marshal(value)
+}
+
+func (MsgpackCodec) Unmarshal(data []byte, value interface{}) error {
+	return msgpack.Unmarshal(data, value)
+}
+
+// JSONCodec encodes values using encoding/json, so they can be read by
+// non-Go services sharing the same redis keys.
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (JSONCodec) Unmarshal(data []byte, value interface{}) error {
+	return json.Unmarshal(data, value)
+}
+
+// GobCodec encodes values using encoding/gob.
+type GobCodec struct{}
+
+func (GobCodec) Marshal(value interface{}) ([]byte, error) {
+	var buff bytes.Buffer
+	if err := gob.NewEncoder(&buff).Encode(value); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, value interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+}
+
+// ProtobufCodec encodes values implementing proto.Message using the protobuf
+// wire format.
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) Marshal(value interface{}) ([]byte, error) {
+	msg, ok := value.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("cache: %T does not implement proto.Message", value)
+	}
+	return proto.Marshal(msg)
+}
+
+func (ProtobufCodec) Unmarshal(data []byte, value interface{}) error {
+	msg, ok := value.(proto.Message)
+	if !ok {
+		return fmt.Errorf("cache: %T does not implement proto.Message", value)
+	}
+	return proto.Unmarshal(data, msg)
+}
@@ -0,0 +1,93 @@
+package hypercache
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestCodecsRoundTrip(t *testing.T) {
+	codecs := map[string]Codec{
+		"msgpack": MsgpackCodec{},
+		"json":    JSONCodec{},
+		"gob":     GobCodec{},
+	}
+	for name, codec := range codecs {
+		buff, err := codec.Marshal(testStruct{Name: "v1", Age: 22})
+		if err != nil {
+			t.Errorf("%s: failed to marshal: %v", name, err)
+			continue
+		}
+		var val testStruct
+		if err := codec.Unmarshal(buff, &val); err != nil {
+			t.Errorf("%s: failed to unmarshal: %v", name, err)
+			continue
+		}
+		if val.Name != "v1" || val.Age != 22 {
+			t.Errorf("%s: failed to round trip value", name)
+		}
+	}
+}
+
+func TestProtobufCodec(t *testing.T) {
+	codec := ProtobufCodec{}
+	buff, err := codec.Marshal(wrapperspb.String("v1"))
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+	val := &wrapperspb.StringValue{}
+	if err := codec.Unmarshal(buff, val); err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	if val.GetValue() != "v1" {
+		t.Errorf("Failed to round trip value")
+	}
+
+	if _, err := codec.Marshal(testStruct{}); err == nil {
+		t.Errorf("Should have failed to marshal a non proto message")
+	}
+}
+
+func TestDefaultSerdeUsesCodec(t *testing.T) {
+	s := newDefaultSerde(JSONCodec{}, newOptions(nil), &cacheStats{})
+	buff, err := s.serialize("k1", testStruct{Name: "v1", Age: 22})
+	if err != nil {
+		t.Fatalf("Failed to serialize: %v", err)
+	}
+	if string(buff) != `{"Name":"v1","Age":22}` {
+		t.Errorf("Should have serialized value as JSON, got %s", buff)
+	}
+
+	buff, err = s.serialize("k1", "v1")
+	if err != nil {
+		t.Fatalf("Failed to serialize: %v", err)
+	}
+	if string(buff) != "v1" {
+		t.Errorf("Should have stored string as-is")
+	}
+}
+
+func TestNamespaceCodec(t *testing.T) {
+	o := newOptions([]Option{
+		WithNamespaceCodec("user:", JSONCodec{}),
+		WithNamespaceCodec("user:session:", GobCodec{}),
+	})
+	serdes, err := o.namespaceSerdes(&cacheStats{})
+	if err != nil {
+		t.Fatalf("Failed to create serdes: %v", err)
+	}
+
+	s, ok := findNamespaceSerde(serdes, "user:1")
+	if !ok || s.(*defaultSerde).codec != (JSONCodec{}) {
+		t.Errorf("Should have used the JSON codec")
+	}
+
+	s, ok = findNamespaceSerde(serdes, "user:session:1")
+	if !ok || s.(*defaultSerde).codec != (GobCodec{}) {
+		t.Errorf("Should have used the longest matching prefix")
+	}
+
+	if _, ok := findNamespaceSerde(serdes, "order:1"); ok {
+		t.Errorf("Should not have matched any namespace")
+	}
+}
@@ -0,0 +1,76 @@
+package hypercache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+
+	"github.com/golang/snappy"
+)
+
+// Compression is the algorithm used to compress stored values.
+type Compression uint8
+
+const (
+	NoCompression Compression = iota
+	GzipCompression
+	ZlibCompression
+	SnappyCompression
+)
+
+// The compression algorithm of a value is stored in the lowest bits of its
+// envelope flags.
+const envelopeCompressionMask byte = 0x07
+
+func (c Compression) compress(data []byte) ([]byte, error) {
+	switch c {
+	case GzipCompression:
+		var buff bytes.Buffer
+		w := gzip.NewWriter(&buff)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buff.Bytes(), nil
+	case ZlibCompression:
+		var buff bytes.Buffer
+		w := zlib.NewWriter(&buff)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buff.Bytes(), nil
+	case SnappyCompression:
+		return snappy.Encode(nil, data), nil
+	}
+	return data, nil
+}
+
+func (c Compression) decompress(data []byte) ([]byte, error) {
+	switch c {
+	case NoCompression:
+		return data, nil
+	case GzipCompression:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case ZlibCompression:
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case SnappyCompression:
+		return snappy.Decode(nil, data)
+	}
+	return nil, ErrUnsupportedFormat
+}
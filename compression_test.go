@@ -0,0 +1,84 @@
+package hypercache
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	value := testStruct{Name: strings.Repeat("v1", 512), Age: 22}
+	for _, compression := range []Compression{GzipCompression, ZlibCompression, SnappyCompression} {
+		stats := &cacheStats{}
+		s := newDefaultSerde(MsgpackCodec{}, newOptions([]Option{WithCompression(compression, 64)}), stats)
+		buff, err := s.serialize("k1", value)
+		if err != nil {
+			t.Fatalf("Failed to serialize with compression %d: %v", compression, err)
+		}
+
+		header, _, err := parseEnvelope(buff)
+		if err != nil {
+			t.Fatalf("Failed to parse envelope: %v", err)
+		}
+		if Compression(header.flags&envelopeCompressionMask) != compression {
+			t.Errorf("Should have flagged value as compressed with %d", compression)
+		}
+
+		var val testStruct
+		if err := s.deserialize("k1", buff, &val); err != nil {
+			t.Fatalf("Failed to deserialize with compression %d: %v", compression, err)
+		}
+		if val != value {
+			t.Errorf("Failed to round trip value with compression %d", compression)
+		}
+
+		snapshot := stats.snapshot()
+		if snapshot.CompressedValues != 1 {
+			t.Errorf("Should have counted compressed value")
+		}
+		if snapshot.CompressionRatio <= 1 {
+			t.Errorf("Should have reported a compression ratio above 1, got %f", snapshot.CompressionRatio)
+		}
+	}
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	stats := &cacheStats{}
+	s := newDefaultSerde(MsgpackCodec{}, newOptions([]Option{WithCompression(GzipCompression, 1024)}), stats)
+	buff, err := s.serialize("k1", testStruct{Name: "v1", Age: 22})
+	if err != nil {
+		t.Fatalf("Failed to serialize: %v", err)
+	}
+
+	header, _, err := parseEnvelope(buff)
+	if err != nil {
+		t.Fatalf("Failed to parse envelope: %v", err)
+	}
+	if header.flags != 0 {
+		t.Errorf("Should not have compressed value below threshold")
+	}
+	if stats.snapshot().CompressedValues != 0 {
+		t.Errorf("Should not have counted uncompressed value")
+	}
+
+	var val testStruct
+	if err := s.deserialize("k1", buff, &val); err != nil || val.Name != "v1" {
+		t.Errorf("Failed to round trip value")
+	}
+}
+
+func TestCompressedValueReadWithoutCompression(t *testing.T) {
+	writer := newDefaultSerde(MsgpackCodec{}, newOptions([]Option{WithCompression(SnappyCompression, 0)}), &cacheStats{})
+	reader := newDefaultSerde(MsgpackCodec{}, newOptions(nil), &cacheStats{})
+
+	buff, err := writer.serialize("k1", strings.Repeat("v1", 512))
+	if err != nil {
+		t.Fatalf("Failed to serialize: %v", err)
+	}
+	val := ""
+	if err := reader.deserialize("k1", buff, &val); err != nil {
+		t.Fatalf("Failed to deserialize: %v", err)
+	}
+	if val != strings.Repeat("v1", 512) {
+		t.Errorf("Failed to decompress value")
+	}
+}
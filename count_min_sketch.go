@@ -0,0 +1,121 @@
+package hypercache
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+)
+
+const (
+	sketchDepth = 4
+	// Counters are 4 bits wide, so they saturate at 15.
+	sketchMaxCount = 15
+)
+
+// countMinSketch estimates how often keys were seen, using 4-bit counters.
+// Counters are halved once the number of increments reaches the sample
+// size, so that old popularity fades away.
+type countMinSketch struct {
+	// Each row packs two counters per byte.
+	rows       [sketchDepth][]byte
+	mask       uint64
+	seed       uint64
+	additions  int
+	sampleSize int
+}
+
+func newCountMinSketch(capacity int64, seed uint64) *countMinSketch {
+	width := nextPowerOfTwo(uint64(capacity))
+	if width < 16 {
+		width = 16
+	}
+	s := &countMinSketch{
+		mask:       width - 1,
+		seed:       seed,
+		sampleSize: 10 * int(width),
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]byte, width/2)
+	}
+	return s
+}
+
+// randomSeed returns a seed for the sketch hash, so that keys colliding in
+// one cache don't collide in every other one.
+func randomSeed() uint64 {
+	var b [8]byte
+	// A zero seed still gives a working sketch, so a failure to read random
+	// bytes is ignored.
+	_, _ = rand.Read(b[:])
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+func nextPowerOfTwo(n uint64) uint64 {
+	p := uint64(1)
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
+
+// indexes returns the counter of the key in each row.
+func (s *countMinSketch) indexes(key string) [sketchDepth]uint64 {
+	h := s.hash(key)
+	h1, h2 := h&0xFFFFFFFF, h>>32
+	var idx [sketchDepth]uint64
+	for i := range idx {
+		idx[i] = (h1 + uint64(i)*h2) & s.mask
+	}
+	return idx
+}
+
+// hash computes the seeded FNV-1a hash of the key, followed by a mixing step
+// spreading its bits across both halves.
+func (s *countMinSketch) hash(key string) uint64 {
+	h := 14695981039346656037 ^ s.seed
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+func (s *countMinSketch) counter(row int, i uint64) byte {
+	return (s.rows[row][i/2] >> ((i % 2) * 4)) & 0x0F
+}
+
+func (s *countMinSketch) increment(key string) {
+	for row, i := range s.indexes(key) {
+		if s.counter(row, i) < sketchMaxCount {
+			s.rows[row][i/2] += 1 << ((i % 2) * 4)
+		}
+	}
+	s.additions++
+	if s.additions >= s.sampleSize {
+		s.reset()
+	}
+}
+
+func (s *countMinSketch) estimate(key string) byte {
+	min := byte(sketchMaxCount)
+	for row, i := range s.indexes(key) {
+		if c := s.counter(row, i); c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+// reset halves every counter.
+func (s *countMinSketch) reset() {
+	for _, row := range s.rows {
+		for i := range row {
+			row[i] = (row[i] >> 1) & 0x77
+		}
+	}
+	s.additions /= 2
+}
@@ -0,0 +1,124 @@
+package hypercache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const encryptionKeyIDSize = 4
+
+var (
+	ErrDecryptionFailed     = errors.New("cache: failed to authenticate encrypted value")
+	ErrUnknownEncryptionKey = errors.New("cache: value was encrypted with an unknown key")
+)
+
+// EncryptionKey is an AES key along with the id stored in front of every
+// value it encrypts.
+type EncryptionKey struct {
+	ID uint32
+	// 16, 24 or 32 bytes to use AES-128, AES-192 or AES-256.
+	Key []byte
+}
+
+/*
+ * encryptingSerde encrypts the output of another serde with AES-GCM.
+ * Encrypted values are laid out as:
+ *
+ *	+--------+-------+------------------+
+ *	| key id | nonce | ciphertext + tag |
+ *	+--------+-------+------------------+
+ *
+ * Values are always encrypted with the current key, and decrypted with
+ * whichever key their id refers to, so keys can be rotated while older
+ * entries are still readable. The key id and the redis key are authenticated
+ * along with the value, so a value copied to another key or relabeled with
+ * another key id fails to decrypt.
+ */
+type encryptingSerde struct {
+	inner     serde
+	currentID uint32
+	aeads     map[uint32]cipher.AEAD
+}
+
+func newEncryptingSerde(inner serde, current EncryptionKey, previous []EncryptionKey) (*encryptingSerde, error) {
+	aeads, err := newAEADs(append([]EncryptionKey{current}, previous...))
+	if err != nil {
+		return nil, err
+	}
+	return &encryptingSerde{
+		inner:     inner,
+		currentID: current.ID,
+		aeads:     aeads,
+	}, nil
+}
+
+// newAEADs creates the ciphers of the keys by id. It fails if a key has an
+// invalid size or if two keys share an id.
+func newAEADs(keys []EncryptionKey) (map[uint32]cipher.AEAD, error) {
+	aeads := make(map[uint32]cipher.AEAD, len(keys))
+	for _, key := range keys {
+		if _, ok := aeads[key.ID]; ok {
+			return nil, fmt.Errorf("cache: duplicate encryption key id %d", key.ID)
+		}
+		block, err := aes.NewCipher(key.Key)
+		if err != nil {
+			return nil, fmt.Errorf("cache: invalid encryption key %d: %w", key.ID, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		aeads[key.ID] = aead
+	}
+	return aeads, nil
+}
+
+// additionalData returns the data authenticated along with a value stored
+// under the redis key: the key id in front of the value, and the redis key.
+func additionalData(keyID []byte, key string) []byte {
+	ad := make([]byte, 0, len(keyID)+len(key))
+	ad = append(ad, keyID...)
+	return append(ad, key...)
+}
+
+func (es *encryptingSerde) serialize(key string, value interface{}) ([]byte, error) {
+	plaintext, err := es.inner.serialize(key, value)
+	if err != nil {
+		return nil, err
+	}
+
+	aead := es.aeads[es.currentID]
+	buff := make([]byte, encryptionKeyIDSize+aead.NonceSize(), encryptionKeyIDSize+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	binary.BigEndian.PutUint32(buff, es.currentID)
+	nonce := buff[encryptionKeyIDSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(buff, nonce, plaintext, additionalData(buff[:encryptionKeyIDSize], key)), nil
+}
+
+func (es *encryptingSerde) deserialize(key string, buff []byte, value interface{}) error {
+	if len(buff) < encryptionKeyIDSize {
+		return ErrDecryptionFailed
+	}
+	aead, ok := es.aeads[binary.BigEndian.Uint32(buff)]
+	if !ok {
+		return ErrUnknownEncryptionKey
+	}
+	ad := additionalData(buff[:encryptionKeyIDSize], key)
+	buff = buff[encryptionKeyIDSize:]
+	if len(buff) < aead.NonceSize() {
+		return ErrDecryptionFailed
+	}
+
+	nonce, ciphertext := buff[:aead.NonceSize()], buff[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return ErrDecryptionFailed
+	}
+	return es.inner.deserialize(key, plaintext, value)
+}
@@ -0,0 +1,111 @@
+package hypercache
+
+import (
+	"bytes"
+	"testing"
+)
+
+var (
+	testKey1 = EncryptionKey{ID: 1, Key: bytes.Repeat([]byte{1}, 32)}
+	testKey2 = EncryptionKey{ID: 2, Key: bytes.Repeat([]byte{2}, 16)}
+)
+
+func newTestEncryptingSerde(t *testing.T, current EncryptionKey, previous ...EncryptionKey) *encryptingSerde {
+	es, err := newEncryptingSerde(newDefaultSerde(MsgpackCodec{}, newOptions(nil), &cacheStats{}), current, previous)
+	if err != nil {
+		t.Fatalf("Failed to create encrypting serde: %v", err)
+	}
+	return es
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	es := newTestEncryptingSerde(t, testKey1)
+	buff, err := es.serialize("k1", testStruct{Name: "v1", Age: 22})
+	if err != nil {
+		t.Fatalf("Failed to serialize: %v", err)
+	}
+	if bytes.Contains(buff, []byte("v1")) {
+		t.Errorf("Should not have stored plaintext")
+	}
+
+	var val testStruct
+	if err := es.deserialize("k1", buff, &val); err != nil {
+		t.Fatalf("Failed to deserialize: %v", err)
+	}
+	if val.Name != "v1" || val.Age != 22 {
+		t.Errorf("Failed to round trip value")
+	}
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	old := newTestEncryptingSerde(t, testKey1)
+	rotated := newTestEncryptingSerde(t, testKey2, testKey1)
+
+	buff, err := old.serialize("k1", "v1")
+	if err != nil {
+		t.Fatalf("Failed to serialize: %v", err)
+	}
+	val := ""
+	if err := rotated.deserialize("k1", buff, &val); err != nil || val != "v1" {
+		t.Errorf("Should have decrypted value with the previous key")
+	}
+
+	buff, err = rotated.serialize("k1", "v2")
+	if err != nil {
+		t.Fatalf("Failed to serialize: %v", err)
+	}
+	if err := old.deserialize("k1", buff, &val); err != ErrUnknownEncryptionKey {
+		t.Errorf("Should have failed with ErrUnknownEncryptionKey, got %v", err)
+	}
+}
+
+func TestEncryptionAuthenticationFailure(t *testing.T) {
+	es := newTestEncryptingSerde(t, testKey1)
+	buff, err := es.serialize("k1", "v1")
+	if err != nil {
+		t.Fatalf("Failed to serialize: %v", err)
+	}
+
+	buff[len(buff)-1] ^= 0xFF
+	val := ""
+	if err := es.deserialize("k1", buff, &val); err != ErrDecryptionFailed {
+		t.Errorf("Should have failed with ErrDecryptionFailed, got %v", err)
+	}
+
+	if err := es.deserialize("k1", []byte("v1"), &val); err != ErrDecryptionFailed && err != ErrUnknownEncryptionKey {
+		t.Errorf("Should have failed to decrypt plaintext value, got %v", err)
+	}
+}
+
+func TestEncryptionBindsValueToKey(t *testing.T) {
+	// Same key material as testKey1 under another id.
+	relabeled := EncryptionKey{ID: 3, Key: testKey1.Key}
+	es := newTestEncryptingSerde(t, testKey1, relabeled)
+	buff, err := es.serialize("k1", "v1")
+	if err != nil {
+		t.Fatalf("Failed to serialize: %v", err)
+	}
+
+	val := ""
+	if err := es.deserialize("k2", buff, &val); err != ErrDecryptionFailed {
+		t.Errorf("Should have failed to decrypt value copied to another key, got %v", err)
+	}
+	buff[encryptionKeyIDSize-1] = byte(relabeled.ID)
+	if err := es.deserialize("k1", buff, &val); err != ErrDecryptionFailed {
+		t.Errorf("Should have failed to decrypt value relabeled with another key id, got %v", err)
+	}
+}
+
+func TestEncryptionInvalidKey(t *testing.T) {
+	_, err := newEncryptingSerde(newDefaultSerde(MsgpackCodec{}, newOptions(nil), &cacheStats{}), EncryptionKey{ID: 1, Key: []byte("short")}, nil)
+	if err == nil {
+		t.Errorf("Should have failed to create serde with an invalid key")
+	}
+}
+
+func TestEncryptionDuplicateKeyID(t *testing.T) {
+	_, err := newEncryptingSerde(newDefaultSerde(MsgpackCodec{}, newOptions(nil), &cacheStats{}), testKey1, []EncryptionKey{{ID: testKey1.ID, Key: testKey2.Key}})
+	if err == nil {
+		t.Errorf("Should have failed to create serde with duplicate key ids")
+	}
+}
@@ -0,0 +1,43 @@
+package hypercache
+
+import "time"
+
+// EntryInfo describes an entry of the in-memory cache.
+type EntryInfo struct {
+	// Time when the key was first added to the in-memory cache.
+	Created time.Time
+	// Time when the value was last updated.
+	Updated time.Time
+	// Time when the entry was last read, or the zero time if it never was.
+	LastAccess time.Time
+	// Number of times the entry was read.
+	Hits uint64
+	// Time until the entry expires from the in-memory cache, or 0 if it
+	// doesn't.
+	TTL time.Duration
+	// Redis hash slot of the key.
+	Slot uint16
+	// Cost of the entry, counted against the maximum cost.
+	Cost int64
+	// Whether the slot of the key was updated by another instance since
+	// the entry was cached, in which case the next read goes to redis.
+	Stale bool
+}
+
+// unixNanoTime returns the time of the given number of nanoseconds since the
+// epoch, or the zero time if it's 0.
+func unixNanoTime(nsec int64) time.Time {
+	if nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nsec)
+}
+
+// unixNano returns the number of nanoseconds since the epoch of the given
+// time, or 0 if it's the zero time.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
@@ -0,0 +1,120 @@
+package hypercache
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+/*
+ * Enveloped values are prefixed with a small header:
+ *
+ *	+-------+---------+----------+-------+
+ *	| magic | version | codec id | flags |
+ *	+-------+---------+----------+-------+
+ *
+ * The magic is 3 bytes long and starts with 0xC1, which is never produced by
+ * msgpack and never starts a valid UTF-8 string. Values written before
+ * envelopes were enabled, and raw payloads of other codecs, are therefore
+ * told apart from enveloped ones and decoded with the configured codec.
+ */
+const (
+	envelopeMagic           = "\xC1HC"
+	envelopeVersion    byte = 1
+	envelopeHeaderSize      = 6
+	// Flags understood by this version.
+	envelopeKnownFlags = envelopeCompressionMask | envelopeChecksumMask
+)
+
+// Codec ids of the built-in codecs. Ids below 16 are reserved.
+const (
+	MsgpackCodecID  uint8 = 1
+	JSONCodecID     uint8 = 2
+	GobCodecID      uint8 = 3
+	ProtobufCodecID uint8 = 4
+)
+
+var (
+	ErrUnknownCodec      = errors.New("cache: value was encoded with an unknown codec")
+	ErrUnsupportedFormat = errors.New("cache: value was encoded with an unsupported format")
+
+	codecsMu   sync.RWMutex
+	codecsByID = map[uint8]Codec{}
+	codecIDs   = map[reflect.Type]uint8{}
+)
+
+func init() {
+	registerCodec(MsgpackCodecID, MsgpackCodec{})
+	registerCodec(JSONCodecID, JSONCodec{})
+	registerCodec(GobCodecID, GobCodec{})
+	registerCodec(ProtobufCodecID, ProtobufCodec{})
+}
+
+// RegisterCodec makes a custom codec known under the given id, so values it
+// encodes can be enveloped and decoded by every instance that registered it.
+// Ids below 16 are reserved for built-in codecs.
+func RegisterCodec(id uint8, codec Codec) {
+	if id < 16 {
+		panic(fmt.Sprintf("cache: codec id %d is reserved", id))
+	}
+	registerCodec(id, codec)
+}
+
+func registerCodec(id uint8, codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecsByID[id] = codec
+	codecIDs[reflect.TypeOf(codec)] = id
+}
+
+func codecByID(id uint8) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	codec, ok := codecsByID[id]
+	return codec, ok
+}
+
+func codecID(codec Codec) (uint8, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	id, ok := codecIDs[reflect.TypeOf(codec)]
+	return id, ok
+}
+
+type envelopeHeader struct {
+	version byte
+	codecID uint8
+	flags   byte
+}
+
+func (h envelopeHeader) appendTo(buff []byte) []byte {
+	buff = append(buff, envelopeMagic...)
+	return append(buff, h.version, h.codecID, h.flags)
+}
+
+// hasEnvelope reports whether the buffer starts with an envelope header.
+func hasEnvelope(buff []byte) bool {
+	return len(buff) >= envelopeHeaderSize && string(buff[:len(envelopeMagic)]) == envelopeMagic
+}
+
+// parseEnvelope splits an enveloped buffer into its header and payload,
+// verifying its checksum if it has one.
+func parseEnvelope(buff []byte) (envelopeHeader, []byte, error) {
+	h := envelopeHeader{
+		version: buff[len(envelopeMagic)],
+		codecID: buff[len(envelopeMagic)+1],
+		flags:   buff[len(envelopeMagic)+2],
+	}
+	if h.version != envelopeVersion || h.flags&^envelopeKnownFlags != 0 {
+		return h, nil, ErrUnsupportedFormat
+	}
+	buff, err := checksumFromFlags(h.flags).verify(buff)
+	if err != nil {
+		return h, nil, err
+	}
+	if len(buff) < envelopeHeaderSize {
+		return h, nil, ErrChecksumMismatch
+	}
+	return h, buff[envelopeHeaderSize:], nil
+}
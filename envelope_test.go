@@ -0,0 +1,113 @@
+package hypercache
+
+import (
+	"testing"
+)
+
+func TestEnvelopeHeader(t *testing.T) {
+	s := newDefaultSerde(JSONCodec{}, newOptions([]Option{WithEnvelope()}), &cacheStats{})
+	buff, err := s.serialize("k1", testStruct{Name: "v1", Age: 22})
+	if err != nil {
+		t.Fatalf("Failed to serialize: %v", err)
+	}
+
+	if !hasEnvelope(buff) {
+		t.Fatalf("Should have prefixed value with an envelope")
+	}
+	header, payload, err := parseEnvelope(buff)
+	if err != nil {
+		t.Fatalf("Failed to parse envelope: %v", err)
+	}
+	if header.version != envelopeVersion || header.codecID != JSONCodecID || header.flags != 0 {
+		t.Errorf("Wrong envelope header %+v", header)
+	}
+	if string(payload) != `{"Name":"v1","Age":22}` {
+		t.Errorf("Wrong envelope payload %s", payload)
+	}
+}
+
+func TestEnvelopeDetectedOnRead(t *testing.T) {
+	writer := newDefaultSerde(JSONCodec{}, newOptions([]Option{WithEnvelope()}), &cacheStats{})
+	// The reader still uses msgpack and doesn't write envelopes.
+	reader := newDefaultSerde(MsgpackCodec{}, newOptions(nil), &cacheStats{})
+
+	buff, err := writer.serialize("k1", testStruct{Name: "v1", Age: 22})
+	if err != nil {
+		t.Fatalf("Failed to serialize: %v", err)
+	}
+	var val testStruct
+	if err := reader.deserialize("k1", buff, &val); err != nil {
+		t.Fatalf("Failed to deserialize: %v", err)
+	}
+	if val.Name != "v1" || val.Age != 22 {
+		t.Errorf("Failed to decode enveloped value")
+	}
+
+	buff, err = writer.serialize("k1", "v1")
+	if err != nil {
+		t.Fatalf("Failed to serialize: %v", err)
+	}
+	str := ""
+	if err := reader.deserialize("k1", buff, &str); err != nil || str != "v1" {
+		t.Errorf("Failed to decode enveloped string")
+	}
+}
+
+func TestEnvelopeReadsLegacyValues(t *testing.T) {
+	legacy := newDefaultSerde(MsgpackCodec{}, newOptions(nil), &cacheStats{})
+	reader := newDefaultSerde(MsgpackCodec{}, newOptions([]Option{WithEnvelope()}), &cacheStats{})
+
+	buff, err := legacy.serialize("k1", testStruct{Name: "v1", Age: 22})
+	if err != nil {
+		t.Fatalf("Failed to serialize: %v", err)
+	}
+	var val testStruct
+	if err := reader.deserialize("k1", buff, &val); err != nil {
+		t.Fatalf("Failed to deserialize: %v", err)
+	}
+	if val.Name != "v1" || val.Age != 22 {
+		t.Errorf("Failed to decode legacy value")
+	}
+}
+
+func TestEnvelopeIgnoresRawPayloadsStartingWithMagicByte(t *testing.T) {
+	s := newDefaultSerde(MsgpackCodec{}, newOptions([]Option{WithEnvelope()}), &cacheStats{})
+	// A raw payload whose first byte is the first byte of the magic, followed
+	// by a valid version and codec id.
+	raw := []byte{0xC1, envelopeVersion, MsgpackCodecID, 0, 0x80}
+	if hasEnvelope(raw) {
+		t.Fatalf("Should not have detected an envelope")
+	}
+	var val []byte
+	if err := s.deserialize("k1", raw, &val); err != nil || string(val) != string(raw) {
+		t.Errorf("Should have decoded the raw payload, got %v %v", val, err)
+	}
+}
+
+func TestEnvelopeRejectsUnknownFormat(t *testing.T) {
+	s := newDefaultSerde(MsgpackCodec{}, newOptions(nil), &cacheStats{})
+	var val testStruct
+
+	buff := envelopeHeader{version: envelopeVersion, codecID: 200}.appendTo(nil)
+	buff = append(buff, 0x80)
+	if err := s.deserialize("k1", buff, &val); err != ErrUnknownCodec {
+		t.Errorf("Should have failed with ErrUnknownCodec, got %v", err)
+	}
+
+	buff = envelopeHeader{version: envelopeVersion + 1, codecID: MsgpackCodecID}.appendTo(nil)
+	buff = append(buff, 0x80)
+	if err := s.deserialize("k1", buff, &val); err != ErrUnsupportedFormat {
+		t.Errorf("Should have failed with ErrUnsupportedFormat, got %v", err)
+	}
+}
+
+type customCodec struct {
+	JSONCodec
+}
+
+func TestEnvelopeWithUnregisteredCodec(t *testing.T) {
+	s := newDefaultSerde(customCodec{}, newOptions([]Option{WithEnvelope()}), &cacheStats{})
+	if _, err := s.serialize("k1", testStruct{}); err == nil {
+		t.Errorf("Should have failed to envelope a value with an unregistered codec")
+	}
+}
@@ -1,16 +1,78 @@
 package hypercache
 
+// EvictionPolicy decides which entries the in-memory cache admits, keeps and
+// evicts. Policies are called with the cache lock held, so they don't need to
+// be safe for concurrent use, and must ignore keys they don't track.
 type EvictionPolicy interface {
-	// This method is called when a new entry is added to the cache.
+	// This method is called when a new entry is added to a full cache.
 	// It should return true if the entry should be added to the cache,
-	// or false if it should be discarded.
+	// evicting the current victim, or false if it should be discarded.
 	ShouldAddEntry(key string, value interface{}) bool
 	// This method is called when an entry is accessed from the cache.
 	// It should return true if the entry should be kept in the cache,
 	// or false if it should be discarded.
 	ShouldKeepEntry(key string, value interface{}) bool
-	// This method is called when an entry is removed from the cache.
-	// It should return true if the entry should be removed from the
-	// cache, or false if it should be kept.
-	ShouldRemoveEntry(key string, value interface{}) bool
+	// This method is called after an entry is added to the cache.
+	EntryAdded(key string, value interface{})
+	// This method is called after an entry is removed from the cache,
+	// whether it was evicted, expired or deleted.
+	EntryRemoved(key string)
+	// This method returns the key of the entry that should be evicted
+	// to make room for a new one, or false if there is none. It is only
+	// called when an entry must be evicted, and EntryRemoved is called
+	// with the returned key right after.
+	Victim() (string, bool)
+}
+
+// ResizablePolicy is implemented by eviction policies that depend on the
+// capacity of the cache, to be told when it changes at runtime.
+type ResizablePolicy interface {
+	EvictionPolicy
+	// This method is called when the maximum number of entries of the
+	// cache changes, before entries are evicted to fit a smaller one.
+	Resize(capacity int64)
+}
+
+// lruPolicy evicts the least recently used entry.
+type lruPolicy struct {
+	// Linked list of keys sorted by last access time.
+	list  *dlList[string]
+	nodes map[string]*dlListNode[string]
+}
+
+// NewLRUPolicy creates a least recently used eviction policy. This is the
+// default policy.
+func NewLRUPolicy(capacity int64) EvictionPolicy {
+	return &lruPolicy{
+		list:  newDLList[string](),
+		nodes: map[string]*dlListNode[string]{},
+	}
+}
+
+func (p *lruPolicy) ShouldAddEntry(key string, value interface{}) bool {
+	return true
+}
+
+func (p *lruPolicy) ShouldKeepEntry(key string, value interface{}) bool {
+	p.list.moveToFront(p.nodes[key])
+	return true
+}
+
+func (p *lruPolicy) EntryAdded(key string, value interface{}) {
+	p.nodes[key] = p.list.pushFront(key)
+}
+
+func (p *lruPolicy) EntryRemoved(key string) {
+	if node, ok := p.nodes[key]; ok {
+		p.list.remove(node)
+		delete(p.nodes, key)
+	}
+}
+
+func (p *lruPolicy) Victim() (string, bool) {
+	node := p.list.back()
+	if node == nil {
+		return "", false
+	}
+	return node.value, true
 }
@@ -0,0 +1,164 @@
+package hypercache
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+var evictionPolicies = map[string]func(capacity int64) EvictionPolicy{
+	"LRU":     NewLRUPolicy,
+	"TinyLFU": NewTinyLFUPolicy,
+	"LFU":     NewLFUPolicy,
+	"ARC":     NewARCPolicy,
+	"2Q":      New2QPolicy,
+	"S3FIFO":  NewS3FIFOPolicy,
+	"CLOCK":   NewClockPolicy,
+}
+
+// skewedTrace returns keys following a zipf distribution, interleaved with
+// scans of keys that are only accessed once.
+func skewedTrace(n int) []string {
+	r := rand.New(rand.NewSource(42))
+	zipf := rand.NewZipf(r, 1.1, 1, 100000)
+	trace := make([]string, 0, n)
+	scanned := 0
+	for len(trace) < n {
+		for i := 0; i < 1000 && len(trace) < n; i++ {
+			trace = append(trace, fmt.Sprintf("hot-%d", zipf.Uint64()))
+		}
+		for i := 0; i < 500 && len(trace) < n; i++ {
+			trace = append(trace, fmt.Sprintf("scan-%d", scanned))
+			scanned++
+		}
+	}
+	return trace
+}
+
+// hitRatio replays the trace against a cache, adding keys on misses.
+func hitRatio(cache *memoryCache, trace []string) float64 {
+	hits := 0
+	for _, key := range trace {
+		if _, ok := cache.Get(key); ok {
+			hits++
+		} else {
+			cache.Set(key, key, 0)
+		}
+	}
+	return float64(hits) / float64(len(trace))
+}
+
+func TestEvictionPoliciesTrackEntries(t *testing.T) {
+	for name, newPolicy := range evictionPolicies {
+		cache := newMemoryCache(100, WithEvictionPolicy(newPolicy))
+		for _, key := range skewedTrace(10000) {
+			if _, ok := cache.Get(key); !ok {
+				cache.Set(key, key, 0)
+			}
+		}
+
+		if cache.Len() != 100 {
+			t.Errorf("%s: cache should be full, has %d entries", name, cache.Len())
+		}
+
+		for i := 0; i < 100; i++ {
+			cache.Delete(fmt.Sprintf("hot-%d", i))
+			cache.Delete(fmt.Sprintf("scan-%d", i))
+		}
+		// Every remaining entry must still be tracked by the policy.
+		for cache.Len() > 0 {
+			victim, ok := cache.shards[0].policy.Victim()
+			if !ok {
+				t.Fatalf("%s: policy lost track of %d entries", name, cache.Len())
+			}
+			cache.Delete(victim)
+		}
+		if _, ok := cache.shards[0].policy.Victim(); ok {
+			t.Errorf("%s: policy should not track any entry", name)
+		}
+	}
+}
+
+func TestEvictionPoliciesResistScans(t *testing.T) {
+	for _, name := range []string{"TinyLFU", "ARC", "2Q", "S3FIFO"} {
+		cache := newMemoryCache(100, WithEvictionPolicy(evictionPolicies[name]))
+		// Add a hot set that is accessed repeatedly. 2Q only considers
+		// entries hot once they come back after leaving its in queue.
+		for round := 0; round < 3; round++ {
+			for i := 0; i < 50; i++ {
+				key := fmt.Sprintf("hot-%d", i)
+				if _, ok := cache.Get(key); !ok {
+					cache.Set(key, i, 0)
+				}
+				cache.Get(key)
+			}
+			for i := 0; i < 100; i++ {
+				cache.Set(fmt.Sprintf("warmup-%d-%d", round, i), i, 0)
+			}
+		}
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("hot-%d", i)
+			if _, ok := cache.Get(key); !ok {
+				cache.Set(key, i, 0)
+			}
+			cache.Get(key)
+		}
+
+		for i := 0; i < 1000; i++ {
+			cache.Set(fmt.Sprintf("scan-%d", i), i, 0)
+		}
+
+		kept := 0
+		for i := 0; i < 50; i++ {
+			if _, ok := cache.Get(fmt.Sprintf("hot-%d", i)); ok {
+				kept++
+			}
+		}
+		if kept < 25 {
+			t.Errorf("%s: should have kept most of the hot set after a scan, kept %d", name, kept)
+		}
+	}
+}
+
+func TestTinyLFUResistsScans(t *testing.T) {
+	trace := skewedTrace(50000)
+	lru := hitRatio(newMemoryCache(500, WithEvictionPolicy(NewLRUPolicy)), trace)
+	tinyLFU := hitRatio(newMemoryCache(500, WithEvictionPolicy(NewTinyLFUPolicy)), trace)
+	if tinyLFU <= lru {
+		t.Errorf("TinyLFU hit ratio %f should be higher than LRU hit ratio %f", tinyLFU, lru)
+	}
+}
+
+func TestCountMinSketch(t *testing.T) {
+	sketch := newCountMinSketch(100, randomSeed())
+	for i := 0; i < 5; i++ {
+		sketch.increment("k1")
+	}
+	if sketch.estimate("k1") < 5 {
+		t.Errorf("Should have estimated at least 5 accesses, got %d", sketch.estimate("k1"))
+	}
+	for i := 0; i < 20; i++ {
+		sketch.increment("k1")
+	}
+	if sketch.estimate("k1") != sketchMaxCount {
+		t.Errorf("Counter should saturate at %d", sketchMaxCount)
+	}
+
+	sketch.reset()
+	if sketch.estimate("k1") != sketchMaxCount/2 {
+		t.Errorf("Reset should halve counters, got %d", sketch.estimate("k1"))
+	}
+}
+
+func BenchmarkHitRatio(b *testing.B) {
+	trace := skewedTrace(200000)
+	for name, newPolicy := range evictionPolicies {
+		b.Run(name, func(b *testing.B) {
+			var ratio float64
+			for i := 0; i < b.N; i++ {
+				ratio = hitRatio(newMemoryCache(1000, WithEvictionPolicy(newPolicy)), trace)
+			}
+			b.ReportMetric(ratio*100, "hit%")
+		})
+	}
+}
@@ -2,11 +2,16 @@ module github.com/migzzi/hypercache
 
 go 1.19
 
+require (
+	github.com/golang/snappy v0.0.4
+	github.com/google/uuid v1.5.0
+	github.com/redis/go-redis/v9 v9.3.1
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	google.golang.org/protobuf v1.33.0
+)
+
 require (
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/google/uuid v1.5.0 // indirect
-	github.com/redis/go-redis/v9 v9.3.1 // indirect
-	github.com/vmihailenco/msgpack/v5 v5.4.1 // indirect
 	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
 )
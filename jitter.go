@@ -0,0 +1,36 @@
+package hypercache
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"time"
+)
+
+// ttlJitter spreads the expiry of keys written with the same TTL, so that
+// they don't all expire at once. TTLs are only ever extended, so keys never
+// expire sooner than asked.
+type ttlJitter struct {
+	// Fraction of the TTL keys may be extended by, or 0 to use max.
+	ratio float64
+	// Duration keys may be extended by, if ratio is 0.
+	max time.Duration
+	// Whether the extension is derived from the key rather than random.
+	deterministic bool
+}
+
+// apply returns the TTL of the key extended by its jitter.
+func (j ttlJitter) apply(key string, ttl time.Duration) time.Duration {
+	spread := j.max
+	if j.ratio > 0 {
+		spread = time.Duration(float64(ttl) * j.ratio)
+	}
+	if ttl <= 0 || spread <= 0 {
+		return ttl
+	}
+	if j.deterministic {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		return ttl + time.Duration(h.Sum64()%uint64(spread+1))
+	}
+	return ttl + time.Duration(rand.Int63n(int64(spread)+1))
+}
@@ -0,0 +1,39 @@
+package hypercache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTTLJitter(t *testing.T) {
+	jitters := map[string]ttlJitter{
+		"ratio":         {ratio: 0.5},
+		"range":         {max: 30 * time.Second},
+		"deterministic": {ratio: 0.5, deterministic: true},
+	}
+	for name, jitter := range jitters {
+		ttls := map[time.Duration]bool{}
+		for i := 0; i < 100; i++ {
+			ttl := jitter.apply(fmt.Sprintf("k%d", i), time.Minute)
+			if ttl < time.Minute || ttl > 90*time.Second {
+				t.Errorf("%s: should extend TTL by up to 30s, got %v", name, ttl)
+			}
+			ttls[ttl] = true
+		}
+		if len(ttls) < 50 {
+			t.Errorf("%s: should spread TTLs, got %d distinct ones", name, len(ttls))
+		}
+		if ttl := jitter.apply("k1", 0); ttl != 0 {
+			t.Errorf("%s: should keep keys without TTL, got %v", name, ttl)
+		}
+	}
+
+	jitter := jitters["deterministic"]
+	if jitter.apply("k1", time.Minute) != jitter.apply("k1", time.Minute) {
+		t.Errorf("Should give a key the same TTL every time")
+	}
+	if ttl := (ttlJitter{}).apply("k1", time.Minute); ttl != time.Minute {
+		t.Errorf("Should not change TTL without jitter, got %v", ttl)
+	}
+}
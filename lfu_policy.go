@@ -0,0 +1,116 @@
+package hypercache
+
+import "container/heap"
+
+type lfuEntry struct {
+	key string
+	// Number of accesses to the entry.
+	count int64
+	// Number of accesses plus the cache age when last accessed.
+	priority int64
+	// Access sequence number, used to evict the least recently used of
+	// entries with the same priority.
+	lastAccess uint64
+	index      int
+}
+
+type lfuHeap []*lfuEntry
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].priority == h[j].priority {
+		return h[i].lastAccess < h[j].lastAccess
+	}
+	return h[i].priority < h[j].priority
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	entry := x.(*lfuEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+/*
+ * lfuPolicy evicts the least frequently used entry, with dynamic aging
+ * (LFU-DA): the priority of an entry is its number of accesses plus the
+ * cache age, which is the priority of the last evicted entry. Entries that
+ * were popular a long time ago therefore eventually get evicted, instead of
+ * staying in the cache forever.
+ */
+type lfuPolicy struct {
+	entries map[string]*lfuEntry
+	heap    lfuHeap
+	// Priority of the last evicted entry.
+	age int64
+	// Incremented on every access.
+	clock uint64
+}
+
+// NewLFUPolicy creates a least frequently used eviction policy with aging.
+func NewLFUPolicy(capacity int64) EvictionPolicy {
+	return &lfuPolicy{
+		entries: map[string]*lfuEntry{},
+	}
+}
+
+func (p *lfuPolicy) ShouldAddEntry(key string, value interface{}) bool {
+	return true
+}
+
+func (p *lfuPolicy) ShouldKeepEntry(key string, value interface{}) bool {
+	entry, ok := p.entries[key]
+	if !ok {
+		return true
+	}
+	entry.count++
+	entry.priority = entry.count + p.age
+	p.clock++
+	entry.lastAccess = p.clock
+	heap.Fix(&p.heap, entry.index)
+	return true
+}
+
+func (p *lfuPolicy) EntryAdded(key string, value interface{}) {
+	p.clock++
+	entry := &lfuEntry{
+		key:        key,
+		count:      1,
+		priority:   p.age + 1,
+		lastAccess: p.clock,
+	}
+	p.entries[key] = entry
+	heap.Push(&p.heap, entry)
+}
+
+func (p *lfuPolicy) EntryRemoved(key string) {
+	entry, ok := p.entries[key]
+	if !ok {
+		return
+	}
+	heap.Remove(&p.heap, entry.index)
+	delete(p.entries, key)
+}
+
+func (p *lfuPolicy) Victim() (string, bool) {
+	if len(p.heap) == 0 {
+		return "", false
+	}
+	victim := p.heap[0]
+	p.age = victim.priority
+	return victim.key, true
+}
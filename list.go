@@ -70,6 +70,8 @@ func (l *dlList[T]) _removeNode(node *dlListNode[T]) {
 	} else {
 		node.next.prev = node.prev
 	}
+	node.prev = nil
+	node.next = nil
 }
 
 func (l *dlList[T]) popBack() T {
@@ -80,13 +82,16 @@ func (l *dlList[T]) popBack() T {
 		return v
 	}
 	v := l.tail.value
-	l.tail = l.tail.prev
-	if l.tail == nil {
-		l.head = nil
-	}
+	l._removeNode(l.tail)
 	return v
 }
 
+func (l *dlList[T]) back() *dlListNode[T] {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.tail
+}
+
 func (l *dlList[T]) moveToFront(node *dlListNode[T]) {
 	if node == nil {
 		return
@@ -103,3 +108,59 @@ func (l *dlList[T]) moveToFront(node *dlListNode[T]) {
 	node.next = l.head
 	l.head = node
 }
+
+// keyList is a list of unique keys, which can be looked up by key.
+type keyList struct {
+	list  *dlList[string]
+	nodes map[string]*dlListNode[string]
+}
+
+func newKeyList() *keyList {
+	return &keyList{
+		list:  newDLList[string](),
+		nodes: map[string]*dlListNode[string]{},
+	}
+}
+
+func (kl *keyList) len() int64 {
+	return int64(len(kl.nodes))
+}
+
+func (kl *keyList) contains(key string) bool {
+	_, ok := kl.nodes[key]
+	return ok
+}
+
+func (kl *keyList) pushFront(key string) {
+	kl.nodes[key] = kl.list.pushFront(key)
+}
+
+func (kl *keyList) moveToFront(key string) {
+	kl.list.moveToFront(kl.nodes[key])
+}
+
+func (kl *keyList) remove(key string) bool {
+	node, ok := kl.nodes[key]
+	if !ok {
+		return false
+	}
+	kl.list.remove(node)
+	delete(kl.nodes, key)
+	return true
+}
+
+func (kl *keyList) back() (string, bool) {
+	node := kl.list.back()
+	if node == nil {
+		return "", false
+	}
+	return node.value, true
+}
+
+func (kl *keyList) popBack() (string, bool) {
+	key, ok := kl.back()
+	if ok {
+		kl.remove(key)
+	}
+	return key, ok
+}
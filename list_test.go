@@ -0,0 +1,28 @@
+package hypercache
+
+import "testing"
+
+func TestDLListMoveToFront(t *testing.T) {
+	l := newDLList[int]()
+	n1 := l.pushBack(1)
+	n2 := l.pushBack(2)
+	l.pushBack(3)
+
+	l.moveToFront(n2)
+	l.remove(n2)
+	l.remove(n1)
+
+	if l.head == nil || l.head.value != 3 || l.head.prev != nil {
+		t.Errorf("List head should be 3")
+	}
+	if l.tail != l.head {
+		t.Errorf("List should only contain 3")
+	}
+
+	if l.popBack() != 3 {
+		t.Errorf("Should have popped 3")
+	}
+	if l.head != nil || l.tail != nil {
+		t.Errorf("List should be empty")
+	}
+}
@@ -1,6 +1,10 @@
 package hypercache
 
 import (
+	"container/heap"
+	"errors"
+	"hash/maphash"
+	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,82 +20,452 @@ type cacheEntry struct {
 	// time at which the entry will expire
 	// expiry time is calculated as: created + ttl
 	expiresAt time.Time
-	// Time when the entry was first added.
-	// created time.Time
-	// // Time when the entry was last updated.
-	// lastUpdated time.Time
-	// // Time when the entry was last accessed.
-	// lastAccessed time.Time
-	// // Number of times the entry has been accessed.
-	// accessCount atomic.Uint64
+	// Cost of the entry, counted against the cache maximum cost.
+	cost int64
+	// Position of the entry in the expiry heap of its shard, or -1 if it
+	// isn't there.
+	expiryIndex int
+	// Time when the key was first added, in nanoseconds since the epoch.
+	created int64
+	// Time when the entry was last updated, in nanoseconds since the epoch.
+	lastUpdated int64
+	// Time when the entry was last accessed, in nanoseconds since the
+	// epoch, or 0 if it never was.
+	lastAccessed atomic.Int64
+	// Number of times the entry has been accessed.
+	accessCount atomic.Uint64
 }
 
+// Number of entries evicted at a time when shrinking a shard, between which
+// the shard lock is released.
+const shrinkBatchSize = 64
+
+var (
+	ErrInvalidCapacity = errors.New("cache: capacity must be positive")
+)
+
 func (ce *cacheEntry) isExpired() bool {
 	return ce.ttl > 0 && time.Now().After(ce.expiresAt)
 }
 
+// remainingTTL returns the time until the entry expires, or 0 if it doesn't.
+func (ce *cacheEntry) remainingTTL() time.Duration {
+	if ce.ttl <= 0 {
+		return 0
+	}
+	return time.Until(ce.expiresAt)
+}
+
+// memoryCache spreads entries across independently locked shards, picked
+// by key hash, so that concurrent accesses to different keys don't contend
+// on the same lock.
 type memoryCache struct {
+	shards []*memoryCacheShard
+	// Used to hash keys to their shard.
+	seed maphash.Seed
+	// This is the maximum number of entries we'll store in the cache.
+	maxEntries *atomic.Int64
+	// Maximum number of entries set by the user, which maxEntries goes
+	// back to once memory pressure is relieved. Guarded by resizeMu.
+	configuredEntries int64
+	// Serializes changes to the maximum number of entries.
+	resizeMu sync.Mutex
+	// Closed to stop the background goroutines, if any.
+	stop       chan struct{}
+	background sync.WaitGroup
+	closeOnce  sync.Once
+	// Evicts entries in the background when the capacity is lowered.
+	shrinker *shrinker
+}
+
+// Shards hold at least this many entries when the number of shards is
+// picked automatically, so that eviction stays close to the policy of an
+// unsharded cache.
+const minShardEntries = 256
+
+func newMemoryCache(maxEntries int64, opts ...Option) *memoryCache {
+	o := newOptions(opts)
+	numShards := nextPowerOfTwo(uint64(o.shards))
+	if o.shards <= 0 {
+		numShards = defaultShardCount(maxEntries)
+		// Every shard must be able to hold an entry of the maximum entry
+		// cost, as entries can't span shards.
+		for o.maxCost > 0 && numShards > 1 && float64(numShards)*o.maxEntryCostRatio > 1 {
+			numShards /= 2
+		}
+	}
+	weigh := defaultWeigh
+	if o.weigher != nil {
+		weigh = func(key string, value interface{}) int64 {
+			return o.weigher(key, serializedValue(value))
+		}
+	}
+
+	// Capacity is split evenly between shards, rounding up. The cost budget
+	// is rounded down, so that the shards never cost more than maxCost in
+	// total.
+	shardEntries := (maxEntries + int64(numShards) - 1) / int64(numShards)
+	var shardCost, maxEntryCost int64
+	if o.maxCost > 0 {
+		shardCost = o.maxCost / int64(numShards)
+		if shardCost < 1 {
+			shardCost = 1
+		}
+		maxEntryCost = int64(float64(o.maxCost) * o.maxEntryCostRatio)
+		if maxEntryCost > shardCost {
+			maxEntryCost = shardCost
+		}
+	}
+
+	mc := &memoryCache{
+		shards:            make([]*memoryCacheShard, numShards),
+		seed:              maphash.MakeSeed(),
+		maxEntries:        &atomic.Int64{},
+		configuredEntries: maxEntries,
+	}
+	mc.shrinker = newShrinker(func(stop <-chan struct{}) {
+		for _, shard := range mc.shards {
+			shard.shrink(stop)
+		}
+	})
+	for i := range mc.shards {
+		mc.shards[i] = newMemoryCacheShard(shardEntries, shardCost, maxEntryCost, o.newPolicy(shardEntries), weigh, o.onRemoval)
+	}
+	mc.maxEntries.Store(maxEntries)
+	if o.janitorInterval > 0 || o.memoryCheckInterval > 0 {
+		mc.stop = make(chan struct{})
+	}
+	if o.janitorInterval > 0 {
+		mc.background.Add(1)
+		go mc.janitor(o.janitorInterval, o.janitorBudget)
+	}
+	if o.memoryCheckInterval > 0 {
+		mc.background.Add(1)
+		go mc.watchMemory(o.memoryCheckInterval, o.memoryCeiling)
+	}
+	return mc
+}
+
+// defaultShardCount returns a number of shards proportional to the number of
+// CPUs, as long as each shard holds at least minShardEntries entries.
+func defaultShardCount(maxEntries int64) uint64 {
+	n := nextPowerOfTwo(uint64(4 * runtime.GOMAXPROCS(0)))
+	for n > 1 && maxEntries/int64(n) < minShardEntries {
+		n /= 2
+	}
+	return n
+}
+
+// serializedValue returns the serialized form of a value stored in the cache.
+func serializedValue(value interface{}) []byte {
+	switch value := value.(type) {
+	case *redisCacheEntry:
+		b, _ := value.value.([]byte)
+		return b
+	case []byte:
+		return value
+	case string:
+		return []byte(value)
+	}
+	return nil
+}
+
+// defaultWeigh returns the size of the key and serialized value of an entry.
+func defaultWeigh(key string, value interface{}) int64 {
+	return int64(len(key) + len(serializedValue(value)))
+}
+
+func (mc *memoryCache) shardFor(key string) *memoryCacheShard {
+	if len(mc.shards) == 1 {
+		return mc.shards[0]
+	}
+	return mc.shards[maphash.String(mc.seed, key)&uint64(len(mc.shards)-1)]
+}
+
+func (mc *memoryCache) Get(key string) (interface{}, bool) {
+	value, _, ok := mc.getWithTTL(key)
+	return value, ok
+}
+
+// getWithTTL returns the value of the key and the time until it expires, or
+// 0 if it doesn't.
+func (mc *memoryCache) getWithTTL(key string) (interface{}, time.Duration, bool) {
+	hash := maphash.String(mc.seed, key)
+	entry, ok := mc.shards[hash&uint64(len(mc.shards)-1)].Get(key, hash)
+	if !ok {
+		return nil, 0, false
+	}
+	return entry.value, entry.remainingTTL(), true
+}
+
+// setExpiry changes when the entry of the key expires without changing its
+// value, or makes it never expire if expiresAt is the zero time. Redis cache
+// entries are also told when their key expires in redis. It returns false if
+// the key isn't cached.
+func (mc *memoryCache) setExpiry(key string, expiresAt, keyExpiresAt time.Time) bool {
+	return mc.shardFor(key).setExpiry(key, expiresAt, keyExpiresAt)
+}
+
+func (mc *memoryCache) Set(key string, value interface{}, ttl time.Duration) error {
+	return mc.shardFor(key).Set(key, value, ttl)
+}
+
+func (mc *memoryCache) Delete(key string) {
+	mc.shardFor(key).Delete(key)
+}
+
+// Resize changes the maximum number of entries of the cache. When it
+// shrinks, entries are evicted down to the new size in the background, and
+// readers are never blocked. Once the cache is closed, they are evicted
+// before Resize returns.
+func (mc *memoryCache) Resize(maxEntries int64) error {
+	if maxEntries <= 0 {
+		return ErrInvalidCapacity
+	}
+	mc.resizeMu.Lock()
+	defer mc.resizeMu.Unlock()
+	mc.configuredEntries = maxEntries
+	mc.resize(maxEntries)
+	return nil
+}
+
+// resize changes the maximum number of entries of the shards, and evicts
+// entries from those holding too many in the background. mc.resizeMu must
+// be held.
+func (mc *memoryCache) resize(maxEntries int64) {
+	numShards := int64(len(mc.shards))
+	shardEntries := (maxEntries + numShards - 1) / numShards
+	mc.maxEntries.Store(maxEntries)
+	overfull := false
+	for _, shard := range mc.shards {
+		if shard.resize(shardEntries) {
+			overfull = true
+		}
+	}
+	if overfull {
+		mc.shrinker.request()
+	}
+}
+
+// Capacity returns the maximum number of entries of the cache.
+func (mc *memoryCache) Capacity() int64 {
+	return mc.maxEntries.Load()
+}
+
+// invalidate removes the entry of the key if it still holds the given value,
+// which must be comparable.
+func (mc *memoryCache) invalidate(key string, value interface{}) {
+	mc.shardFor(key).invalidate(key, value)
+}
+
+// Inspect returns the metadata of the entry of the key. Inspecting an entry
+// doesn't count as an access.
+func (mc *memoryCache) Inspect(key string) (EntryInfo, bool) {
+	info, _, ok := mc.inspect(key)
+	return info, ok
+}
+
+// inspect returns the metadata and value of the entry of the key.
+func (mc *memoryCache) inspect(key string) (EntryInfo, interface{}, bool) {
+	item, ok := mc.shardFor(key).cache.Load(key)
+	if !ok {
+		return EntryInfo{}, nil, false
+	}
+	entry := item.(*cacheEntry)
+	if entry.isExpired() {
+		return EntryInfo{}, nil, false
+	}
+	info := EntryInfo{
+		Created:    unixNanoTime(entry.created),
+		Updated:    unixNanoTime(entry.lastUpdated),
+		LastAccess: unixNanoTime(entry.lastAccessed.Load()),
+		Hits:       entry.accessCount.Load(),
+		Cost:       entry.cost,
+	}
+	info.TTL = entry.remainingTTL()
+	if value, ok := entry.value.(*redisCacheEntry); ok {
+		info.Slot = value.keyHashSlot
+	}
+	return info, entry.value, true
+}
+
+// Close stops the background goroutines, if any, and waits for them to
+// return. The cache can still be used afterwards.
+func (mc *memoryCache) Close() {
+	mc.closeOnce.Do(func() {
+		mc.shrinker.close()
+		if mc.stop != nil {
+			close(mc.stop)
+			mc.background.Wait()
+		}
+	})
+}
+
+// janitor removes expired entries every interval until the cache is closed.
+func (mc *memoryCache) janitor(interval time.Duration, budget int) {
+	defer mc.background.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	// Shard the next run starts from, so that shards are cleaned evenly
+	// when the budget runs out.
+	next := 0
+	for {
+		select {
+		case <-mc.stop:
+			return
+		case <-ticker.C:
+			next = mc.removeExpired(next, budget)
+		}
+	}
+}
+
+// removeExpired removes at most budget expired entries, or all of them if
+// budget is 0, starting from the given shard. It returns the shard to start
+// from next time.
+func (mc *memoryCache) removeExpired(first, budget int) int {
+	for i := 0; i < len(mc.shards); i++ {
+		shard := mc.shards[(first+i)%len(mc.shards)]
+		shard.mu.Lock()
+		removed := shard.removeExpired(budget)
+		shard.unlock()
+		if budget > 0 {
+			budget -= removed
+			if budget == 0 {
+				return (first + i + 1) % len(mc.shards)
+			}
+		}
+	}
+	return first
+}
+
+// Len returns the number of entries in the cache.
+func (mc *memoryCache) Len() int64 {
+	var n int64
+	for _, shard := range mc.shards {
+		n += shard.numEntries.Load()
+	}
+	return n
+}
+
+// Cost returns the total cost of the entries in the cache.
+func (mc *memoryCache) Cost() int64 {
+	var cost int64
+	for _, shard := range mc.shards {
+		cost += shard.totalCost.Load()
+	}
+	return cost
+}
+
+// memoryCacheShard holds the entries of the keys assigned to one shard of a
+// memoryCache, with its own lock, eviction policy and counters.
+type memoryCacheShard struct {
 	// This is the cache itself. It's a map of strings to
 	// cacheEntry pointers.
 	cache sync.Map
-	// Linked list of cache entries sorted by last access time.
-	// This is used to remove the oldest entry when the cache
-	// is full.
-	list *dlList[*cacheEntry]
+	// Decides which entries are admitted to the cache, and which
+	// one is removed when the cache is full.
+	policy EvictionPolicy
+	// Guards the policy and serializes changes to the cache.
+	mu sync.Mutex
+	// Accesses recorded by Get, applied to the policy in batches.
+	accesses accessBuffer
+	// Entries having a TTL, soonest to expire first.
+	expiries expiryHeap
 	// This is the maximum number of entries we'll store in the cache.
 	maxEntries *atomic.Int64
 	// This is the number of entries currently in the cache.
 	numEntries *atomic.Int64
+	// This is the maximum total cost of the entries, or 0 if unbounded.
+	maxCost int64
+	// Entries costing more than this are not added to the cache.
+	maxEntryCost int64
+	// This is the total cost of the entries currently in the cache.
+	totalCost *atomic.Int64
+	// Returns the cost of an entry.
+	weigh func(key string, value interface{}) int64
+	// Called with the entries removed from the cache, or nil.
+	onRemoval RemovalListener
+	// Entries removed while s.mu was held, reported once it's released.
+	removed []removal
 }
 
-func newMemoryCache(maxEntries int64) *memoryCache {
-	mc := &memoryCache{
-		maxEntries: &atomic.Int64{},
-		numEntries: &atomic.Int64{},
-		list:       newDLList[*cacheEntry](),
+func newMemoryCacheShard(maxEntries, maxCost, maxEntryCost int64, policy EvictionPolicy, weigh func(key string, value interface{}) int64, onRemoval RemovalListener) *memoryCacheShard {
+	s := &memoryCacheShard{
+		maxEntries:   &atomic.Int64{},
+		numEntries:   &atomic.Int64{},
+		totalCost:    &atomic.Int64{},
+		policy:       policy,
+		maxCost:      maxCost,
+		maxEntryCost: maxEntryCost,
+		weigh:        weigh,
+		onRemoval:    onRemoval,
 	}
-	mc.maxEntries.Store(maxEntries)
-	mc.numEntries.Store(0)
-	return mc
+	s.maxEntries.Store(maxEntries)
+	s.numEntries.Store(0)
+	return s
 }
 
-func (mc *memoryCache) Get(key string) (interface{}, bool) {
+// Get looks up an entry without locking the shard. The access is recorded
+// in a buffer and applied to the policy later, so an entry the policy
+// decides not to keep is only removed once the buffer is drained.
+func (s *memoryCacheShard) Get(key string, hash uint64) (*cacheEntry, bool) {
 	// Get the cache entry from the map.
-	entry, ok := mc.cache.Load(key)
+	item, ok := s.cache.Load(key)
 	if !ok {
 		return nil, false
 	}
 	// Cast the entry to a *cacheEntry.
-	item := entry.(*dlListNode[*cacheEntry])
-	cacheEntry := item.value
+	entry := item.(*cacheEntry)
 	// Check if the entry has expired.
-	if cacheEntry.isExpired() {
+	if entry.isExpired() {
 		// The entry has expired, so delete it from the cache.
-		mc.Delete(key)
+		s.mu.Lock()
+		s.removeEntry(entry, RemovalExpired)
+		s.unlock()
 		return nil, false
 	}
 
-	mc.list.moveToFront(item)
-	// Return the value and true to indicate success.
-	return cacheEntry.value, true
+	entry.accessCount.Add(1)
+	entry.lastAccessed.Store(time.Now().UnixNano())
+	if s.accesses.record(hash, entry) && s.mu.TryLock() {
+		// Readers never wait for the lock. If it's busy, the buffer
+		// is drained by a later access or by the next write.
+		s.drainAccesses()
+		s.unlock()
+	}
+	// Return the entry and true to indicate success.
+	return entry, true
 }
 
-func (mc *memoryCache) Set(key string, value interface{}, ttl time.Duration) error {
-	now := time.Now()
-	item, ok := mc.cache.Load(key)
-	// Check if the entry already exists.
-	if ok {
-		listItem := item.(*dlListNode[*cacheEntry])
-		entry := listItem.value
-		// The entry already exists, so update it.
-		entry.value = value
-		mc.list.moveToFront(listItem)
-		return nil
+// drainAccesses applies the accesses recorded by Get to the policy. s.mu
+// must be held.
+func (s *memoryCacheShard) drainAccesses() {
+	s.accesses.drain(s.applyAccess)
+}
+
+// applyAccess tells the policy that the entry was accessed, and removes it if
+// the policy doesn't keep it. s.mu must be held.
+func (s *memoryCacheShard) applyAccess(entry *cacheEntry) {
+	// The entry may have been replaced or removed since it was accessed.
+	item, ok := s.cache.Load(entry.key)
+	if !ok || item.(*cacheEntry) != entry {
+		return
+	}
+	if !s.policy.ShouldKeepEntry(entry.key, entry.value) {
+		s.removeEntry(entry, RemovalEvicted)
 	}
+}
+
+func (s *memoryCacheShard) Set(key string, value interface{}, ttl time.Duration) error {
+	now := time.Now()
 	// Create a new cache entry.
 	entry := &cacheEntry{
-		key:   key,
-		value: value,
+		key:         key,
+		value:       value,
+		cost:        s.weigh(key, value),
+		expiryIndex: -1,
+		created:     now.UnixNano(),
+		lastUpdated: now.UnixNano(),
 	}
 	// Set the TTL if one was provided.
 	if ttl != 0 {
@@ -99,63 +473,260 @@ func (mc *memoryCache) Set(key string, value interface{}, ttl time.Duration) err
 		entry.expiresAt = now.Add(ttl)
 	}
 
-	mc.evictIfNeeded()
-	item = mc.list.pushFront(entry)
+	s.mu.Lock()
+	defer s.unlock()
+	// Let the policy see recent accesses before it picks any victim.
+	s.drainAccesses()
+	// Check if the entry already exists.
+	if item, ok := s.cache.Load(key); ok {
+		if s.maxEntryCost > 0 && entry.cost > s.maxEntryCost {
+			// The new value is too large, don't keep the old one around.
+			s.removeEntry(item.(*cacheEntry), RemovalReplaced)
+			return nil
+		}
+		// The entry already exists, so replace it.
+		old := item.(*cacheEntry)
+		entry.created = old.created
+		s.cache.Store(key, entry)
+		s.totalCost.Add(entry.cost - old.cost)
+		s.untrackExpiry(old)
+		s.trackExpiry(entry)
+		s.notify(old, RemovalReplaced)
+		if !s.policy.ShouldKeepEntry(key, value) {
+			s.removeEntry(entry, RemovalEvicted)
+		}
+		s.evictOverCost()
+		return nil
+	}
+
+	if !s.evictIfNeeded(entry) {
+		// The policy refused to admit the entry.
+		return nil
+	}
 	// Add the entry to the cache.
-	mc.cache.Store(key, item)
-	mc.numEntries.Add(1)
+	s.cache.Store(key, entry)
+	s.trackExpiry(entry)
+	s.numEntries.Add(1)
+	s.totalCost.Add(entry.cost)
+	s.policy.EntryAdded(key, value)
 	return nil
 }
 
-func (mc *memoryCache) Delete(key string) {
+func (s *memoryCacheShard) setExpiry(key string, expiresAt, keyExpiresAt time.Time) bool {
+	s.mu.Lock()
+	defer s.unlock()
+	item, ok := s.cache.Load(key)
+	if !ok {
+		return false
+	}
+	old := item.(*cacheEntry)
+	if old.isExpired() || (!expiresAt.IsZero() && !expiresAt.After(time.Now())) {
+		s.removeEntry(old, RemovalExpired)
+		return !old.isExpired()
+	}
+
+	// Entries are read without locking, so they are copied rather than
+	// modified.
+	value := old.value
+	if redisEntry, ok := value.(*redisCacheEntry); ok {
+		copied := *redisEntry
+		copied.expiresAt = unixNano(keyExpiresAt)
+		value = &copied
+	}
+	entry := &cacheEntry{
+		key:         old.key,
+		value:       value,
+		cost:        old.cost,
+		expiryIndex: -1,
+		created:     old.created,
+		lastUpdated: old.lastUpdated,
+	}
+	entry.lastAccessed.Store(old.lastAccessed.Load())
+	entry.accessCount.Store(old.accessCount.Load())
+	if !expiresAt.IsZero() {
+		entry.ttl = time.Until(expiresAt)
+		entry.expiresAt = expiresAt
+	}
+	s.cache.Store(key, entry)
+	s.untrackExpiry(old)
+	s.trackExpiry(entry)
+	return true
+}
+
+func (s *memoryCacheShard) Delete(key string) {
+	s.mu.Lock()
+	defer s.unlock()
 	// Get the entry from the cache.
-	item, ok := mc.cache.Load(key)
+	item, ok := s.cache.Load(key)
 	if !ok {
 		return
 	}
-	// Remove the entry from the list.
-	mc.list.remove(item.(*dlListNode[*cacheEntry]))
-	// Delete the entry from the cache.
-	mc.cache.Delete(key)
-	mc.numEntries.Add(-1)
+	s.removeEntry(item.(*cacheEntry), RemovalDeleted)
 }
 
-func (mc *memoryCache) evictIfNeeded() bool {
-	// Check if we've exceeded the maximum number of entries.
-	if mc.numEntries.Load() >= mc.maxEntries.Load() { // TODO: this is not thread safe
-		// Check if we have expired entries.
-		if !mc.checkAndRemoveExpired() {
-			// We've exceeded the maximum number of entries, so we need to
-			// Get the oldest entry from the list.
-			entry := mc.list.popBack()
-			// Remove the entry from the cache.
-			mc.cache.Delete(entry.key)
-			mc.numEntries.Add(-1)
+// resize changes the maximum number of entries of the shard, and returns
+// whether it holds more entries than that.
+func (s *memoryCacheShard) resize(maxEntries int64) bool {
+	s.mu.Lock()
+	defer s.unlock()
+	s.maxEntries.Store(maxEntries)
+	if policy, ok := s.policy.(ResizablePolicy); ok {
+		policy.Resize(maxEntries)
+	}
+	return s.numEntries.Load() > maxEntries
+}
+
+// shrink evicts entries until the shard fits its maximum number of entries,
+// releasing the lock between batches so that writers aren't held up. It
+// returns early once stop is closed.
+func (s *memoryCacheShard) shrink(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		s.mu.Lock()
+		s.drainAccesses()
+		done := false
+		for i := 0; i < shrinkBatchSize && !done; i++ {
+			done = s.numEntries.Load() <= s.maxEntries.Load() || !s.evictVictim()
+		}
+		done = done || s.numEntries.Load() <= s.maxEntries.Load()
+		s.unlock()
+		if done {
+			return
 		}
+	}
+}
+
+func (s *memoryCacheShard) invalidate(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.unlock()
+	if item, ok := s.cache.Load(key); ok && item.(*cacheEntry).value == value {
+		s.removeEntry(item.(*cacheEntry), RemovalInvalidated)
+	}
+}
+
+// removeEntry deletes the entry from the cache unless its key has been
+// given another entry in the meantime. s.mu must be held.
+func (s *memoryCacheShard) removeEntry(entry *cacheEntry, reason RemovalReason) {
+	item, ok := s.cache.Load(entry.key)
+	if !ok || item.(*cacheEntry) != entry {
+		return
+	}
+	s.cache.Delete(entry.key)
+	s.untrackExpiry(entry)
+	s.numEntries.Add(-1)
+	s.totalCost.Add(-entry.cost)
+	s.policy.EntryRemoved(entry.key)
+	s.notify(entry, reason)
+}
+
+// notify records that the entry was removed, to report it once s.mu is
+// released. s.mu must be held.
+func (s *memoryCacheShard) notify(entry *cacheEntry, reason RemovalReason) {
+	if s.onRemoval != nil {
+		s.removed = append(s.removed, removal{entry, reason})
+	}
+}
+
+// unlock releases s.mu, then reports the entries removed while it was held,
+// so that listeners can use the cache.
+func (s *memoryCacheShard) unlock() {
+	removed := s.removed
+	s.removed = nil
+	s.mu.Unlock()
+	for _, r := range removed {
+		s.onRemoval(r.entry.key, r.entry.value, r.reason)
+	}
+}
+
+// trackExpiry adds the entry to the expiry heap if it has a TTL. s.mu must
+// be held.
+func (s *memoryCacheShard) trackExpiry(entry *cacheEntry) {
+	if entry.ttl > 0 {
+		heap.Push(&s.expiries, entry)
+	}
+}
+
+// untrackExpiry removes the entry from the expiry heap. s.mu must be held.
+func (s *memoryCacheShard) untrackExpiry(entry *cacheEntry) {
+	if entry.expiryIndex >= 0 {
+		heap.Remove(&s.expiries, entry.expiryIndex)
+	}
+}
+
+// hasRoomFor reports whether the entry can be added without exceeding the
+// maximum number of entries or cost. s.mu must be held.
+func (s *memoryCacheShard) hasRoomFor(entry *cacheEntry) bool {
+	if s.numEntries.Load() >= s.maxEntries.Load() {
+		return false
+	}
+	return s.maxCost == 0 || s.totalCost.Load()+entry.cost <= s.maxCost
+}
+
+// evictIfNeeded makes room for a new entry, and returns false if it
+// shouldn't be added. s.mu must be held.
+func (s *memoryCacheShard) evictIfNeeded(entry *cacheEntry) bool {
+	if s.maxEntryCost > 0 && entry.cost > s.maxEntryCost {
+		return false
+	}
+	// Check if we've exceeded the maximum number of entries.
+	if s.hasRoomFor(entry) {
+		return true
+	}
+	// Check if we have expired entries.
+	if s.removeExpired(0) > 0 && s.hasRoomFor(entry) {
 		return true
 	}
-	return false
+	if !s.policy.ShouldAddEntry(entry.key, entry.value) {
+		return false
+	}
+	// We've exceeded the maximum number of entries, so we need to
+	// remove the entries chosen by the policy.
+	for !s.hasRoomFor(entry) {
+		if !s.evictVictim() {
+			break
+		}
+	}
+	return true
 }
 
-/*
- * TODO: In case of large number of entries, this function can be called in a separate goroutine
- * Or a tree-like structure can be used to store the entries sorted by expiration time
- * for faster removal of expired entries.
- */
-func (mc *memoryCache) checkAndRemoveExpired() bool {
-	var expiredKeys []string
-	mc.cache.Range(func(key, value interface{}) bool {
-		entry := value.(*dlListNode[*cacheEntry]).value
-		// Check if the entry has expired.
-		if entry.isExpired() {
-			// The entry has expired, so delete it from the cache.
-			expiredKeys = append(expiredKeys, key.(string))
+// evictOverCost evicts entries until the total cost is within the maximum
+// cost. s.mu must be held.
+func (s *memoryCacheShard) evictOverCost() {
+	for s.maxCost > 0 && s.totalCost.Load() > s.maxCost {
+		if !s.evictVictim() {
+			break
 		}
-		return true
-	})
-	// Delete the expired entries from the cache.
-	for _, key := range expiredKeys {
-		mc.Delete(key)
 	}
-	return len(expiredKeys) > 0
+}
+
+// evictVictim removes the entry chosen by the policy, and returns false if
+// there was none. s.mu must be held.
+func (s *memoryCacheShard) evictVictim() bool {
+	victim, ok := s.policy.Victim()
+	if !ok {
+		return false
+	}
+	if item, ok := s.cache.Load(victim); ok {
+		s.removeEntry(item.(*cacheEntry), RemovalEvicted)
+	} else {
+		s.policy.EntryRemoved(victim)
+	}
+	return true
+}
+
+// removeExpired removes at most limit expired entries, or all of them if
+// limit is 0, popping them from the expiry heap. It returns the number of
+// entries removed. s.mu must be held.
+func (s *memoryCacheShard) removeExpired(limit int) int {
+	removed := 0
+	for len(s.expiries) > 0 && s.expiries[0].isExpired() && (limit <= 0 || removed < limit) {
+		entry := heap.Pop(&s.expiries).(*cacheEntry)
+		s.removeEntry(entry, RemovalExpired)
+		removed++
+	}
+	return removed
 }
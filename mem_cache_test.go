@@ -2,6 +2,9 @@ package hypercache
 
 import (
 	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 )
@@ -16,7 +19,7 @@ func TestCreateMemCache(t *testing.T) {
 		t.Errorf("Failed to create maxEntries")
 	}
 
-	if cache.numEntries.Load() != 0 {
+	if cache.Len() != 0 {
 		t.Errorf("Failed to create numEntries")
 	}
 }
@@ -28,7 +31,7 @@ func TestMemCacheAdd(t *testing.T) {
 	}
 
 	cache.Set("k1", "v1", 0)
-	if cache.numEntries.Load() != 1 {
+	if cache.Len() != 1 {
 		t.Errorf("Failed to add entry")
 	}
 }
@@ -41,16 +44,20 @@ func TestMemCacheAddExisting(t *testing.T) {
 
 	cache.Set("k1", "v1", 0)
 	cache.Set("k1", "v2", 0)
-	if cache.numEntries.Load() != 1 {
+	if cache.Len() != 1 {
 		t.Errorf("Failed to add entry")
 	}
 
-	item := cache.list.popBack()
-	if item.value != "v2" {
-		t.Errorf("List should point to entry with value v2")
+	if val, _ := cache.Get("k1"); val != "v2" {
+		t.Errorf("Cache should point to entry with value v2")
 	}
 
-	if cache.list.head != nil {
+	list := cache.shards[0].policy.(*lruPolicy).list
+	if list.popBack() != "k1" {
+		t.Errorf("List should point to entry k1")
+	}
+
+	if list.head != nil {
 		t.Errorf("List head should be nil")
 	}
 }
@@ -103,7 +110,7 @@ func TestMemCacheDelete(t *testing.T) {
 
 	cache.Set("k1", "v1", 0)
 	cache.Delete("k1")
-	if cache.numEntries.Load() != 0 {
+	if cache.Len() != 0 {
 		t.Errorf("Failed to delete entry")
 	}
 
@@ -123,7 +130,7 @@ func TestMemCacheEvict(t *testing.T) {
 		cache.Set(fmt.Sprintf("%d", i), i, 0)
 	}
 
-	if cache.numEntries.Load() != 10 {
+	if cache.Len() != 10 {
 		t.Errorf("Failed to evict entries")
 	}
 
@@ -152,7 +159,7 @@ func TestMemCacheEvictWithExpiry(t *testing.T) {
 		cache.Set(fmt.Sprintf("%d", i), i, 100*time.Millisecond)
 	}
 
-	if cache.numEntries.Load() != 10 {
+	if cache.Len() != 10 {
 		t.Errorf("Failed to evict entries")
 	}
 
@@ -162,7 +169,7 @@ func TestMemCacheEvictWithExpiry(t *testing.T) {
 		cache.Set(fmt.Sprintf("%d", i), i, 100*time.Millisecond)
 	}
 
-	if cache.numEntries.Load() != 5 {
+	if cache.Len() != 5 {
 		t.Errorf("Failed to evict entries")
 	}
 
@@ -173,3 +180,647 @@ func TestMemCacheEvictWithExpiry(t *testing.T) {
 		}
 	}
 }
+
+func TestMemCacheExpiryIndex(t *testing.T) {
+	cache := newMemoryCache(10, WithShards(1))
+	shard := cache.shards[0]
+
+	cache.Set("short", 1, 50*time.Millisecond)
+	cache.Set("long", 2, time.Hour)
+	cache.Set("forever", 3, 0)
+	cache.Set("replaced", 4, 50*time.Millisecond)
+	cache.Set("replaced", 5, time.Hour)
+	cache.Set("deleted", 6, 50*time.Millisecond)
+	cache.Delete("deleted")
+
+	// Only live entries having a TTL are indexed.
+	if len(shard.expiries) != 3 {
+		t.Errorf("Should index 3 entries, indexed %d", len(shard.expiries))
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	shard.mu.Lock()
+	removed := shard.removeExpired(0)
+	shard.mu.Unlock()
+
+	if removed != 1 {
+		t.Errorf("Should have removed expired entry")
+	}
+	if cache.Len() != 3 || len(shard.expiries) != 2 {
+		t.Errorf("Should have removed only the expired entry")
+	}
+	if _, ok := cache.Get("replaced"); !ok {
+		t.Errorf("Should have applied the TTL of the new value")
+	}
+}
+
+func TestMemCacheJanitor(t *testing.T) {
+	cache := newMemoryCache(100, WithShards(4), WithJanitor(20*time.Millisecond, 0))
+	defer cache.Close()
+
+	for i := 0; i < 50; i++ {
+		cache.Set(fmt.Sprintf("%d", i), i, 10*time.Millisecond)
+	}
+	cache.Set("forever", 1, 0)
+
+	time.Sleep(100 * time.Millisecond)
+	if cache.Len() != 1 {
+		t.Errorf("Janitor should have removed expired entries, %d left", cache.Len())
+	}
+}
+
+func TestMemCacheJanitorBudget(t *testing.T) {
+	cache := newMemoryCache(100, WithShards(4))
+	for i := 0; i < 50; i++ {
+		cache.Set(fmt.Sprintf("%d", i), i, time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	next := 0
+	for run := 1; run <= 5; run++ {
+		next = cache.removeExpired(next, 10)
+		if cache.Len() != int64(50-10*run) {
+			t.Fatalf("Run %d should have removed 10 entries, %d left", run, cache.Len())
+		}
+	}
+}
+
+func TestMemCacheCloseStopsJanitor(t *testing.T) {
+	cache := newMemoryCache(100, WithJanitor(10*time.Millisecond, 0))
+	cache.Close()
+	// Closing twice is harmless.
+	cache.Close()
+
+	select {
+	case <-cache.stop:
+	default:
+		t.Errorf("Janitor should have stopped")
+	}
+
+	cache.Set("k1", "v1", time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	if cache.Len() != 1 {
+		t.Errorf("Janitor should not run after the cache is closed")
+	}
+}
+
+type removalRecorder struct {
+	mu       sync.Mutex
+	removals map[string]RemovalReason
+}
+
+func (r *removalRecorder) listener(key string, value interface{}, reason RemovalReason) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.removals[key] = reason
+}
+
+func (r *removalRecorder) reason(key string) (RemovalReason, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reason, ok := r.removals[key]
+	return reason, ok
+}
+
+func TestMemCacheOnRemoval(t *testing.T) {
+	recorder := &removalRecorder{removals: map[string]RemovalReason{}}
+	cache := newMemoryCache(3, WithOnRemoval(recorder.listener))
+
+	cache.Set("expired", 1, time.Millisecond)
+	cache.Set("deleted", 2, 0)
+	cache.Set("replaced", 3, 0)
+	time.Sleep(10 * time.Millisecond)
+
+	cache.Get("expired")
+	cache.Delete("deleted")
+	cache.Set("replaced", 4, 0)
+	cache.Set("k1", 5, 0)
+	cache.Set("k2", 6, 0)
+	cache.Set("k3", 7, 0)
+
+	expected := map[string]RemovalReason{
+		"expired":  RemovalExpired,
+		"deleted":  RemovalDeleted,
+		"replaced": RemovalEvicted,
+	}
+	for key, want := range expected {
+		if reason, ok := recorder.reason(key); !ok || reason != want {
+			t.Errorf("%s: should have been removed as %v, got %v", key, want, reason)
+		}
+	}
+}
+
+func TestMemCacheOnRemovalReplaced(t *testing.T) {
+	var value interface{}
+	var reason RemovalReason
+	cache := newMemoryCache(3, WithOnRemoval(func(k string, v interface{}, r RemovalReason) {
+		value, reason = v, r
+	}))
+
+	cache.Set("k1", "v1", 0)
+	cache.Set("k1", "v2", 0)
+
+	if value != "v1" || reason != RemovalReplaced {
+		t.Errorf("Should report the old value as replaced, got %v %v", value, reason)
+	}
+}
+
+func TestMemCacheOnRemovalOutsideLock(t *testing.T) {
+	var cache *memoryCache
+	cache = newMemoryCache(1, WithOnRemoval(func(key string, value interface{}, reason RemovalReason) {
+		// Would deadlock if called with the shard lock held.
+		cache.Get(key)
+		cache.Len()
+	}))
+
+	cache.Set("k1", "v1", 0)
+	cache.Set("k2", "v2", 0)
+	cache.Delete("k2")
+
+	if cache.Len() != 0 {
+		t.Errorf("Failed to remove entries")
+	}
+}
+
+func TestMemCacheResize(t *testing.T) {
+	cache := newMemoryCache(100, WithShards(4))
+	for i := 0; i < 100; i++ {
+		cache.Set(fmt.Sprintf("%d", i), i, 0)
+	}
+
+	if err := cache.Resize(40); err != nil {
+		t.Fatalf("Failed to resize: %v", err)
+	}
+	if cache.Capacity() != 40 {
+		t.Errorf("Capacity should be 40, got %d", cache.Capacity())
+	}
+	for i := 0; i < 100 && cache.Len() > 40; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if cache.Len() != 40 {
+		t.Errorf("Should have evicted down to 40 entries, has %d", cache.Len())
+	}
+
+	if err := cache.Resize(200); err != nil {
+		t.Fatalf("Failed to resize: %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		cache.Set(fmt.Sprintf("new-%d", i), i, 0)
+	}
+	if cache.Len() < 160 {
+		t.Errorf("Should have grown to about 200 entries, has %d", cache.Len())
+	}
+
+	if err := cache.Resize(0); err != ErrInvalidCapacity {
+		t.Errorf("Should refuse a capacity of 0, got %v", err)
+	}
+}
+
+func TestMemCacheCloseWaitsForShrinks(t *testing.T) {
+	cache := newMemoryCache(100000, WithShards(4))
+	for i := 0; i < 100000; i++ {
+		cache.Set(fmt.Sprintf("%d", i), i, 0)
+	}
+	for _, capacity := range []int64{50000, 10000, 100} {
+		cache.Resize(capacity)
+	}
+	cache.Close()
+
+	// No shrink runs once Close returned.
+	n := cache.Len()
+	time.Sleep(10 * time.Millisecond)
+	if cache.Len() != n {
+		t.Errorf("Should not evict entries after Close, had %d entries, has %d", n, cache.Len())
+	}
+
+	// Resizing a closed cache evicts entries right away.
+	cache.Resize(20)
+	if cache.Len() > 20 {
+		t.Errorf("Should have evicted down to 20 entries, has %d", cache.Len())
+	}
+}
+
+func TestMemCacheResizePolicies(t *testing.T) {
+	for name, newPolicy := range evictionPolicies {
+		cache := newMemoryCache(100, WithShards(1), WithEvictionPolicy(newPolicy))
+		for i := 0; i < 100; i++ {
+			cache.Set(fmt.Sprintf("%d", i), i, 0)
+		}
+
+		cache.Resize(10)
+		cache.shards[0].shrink(nil)
+		if cache.Len() != 10 {
+			t.Errorf("%s: should have evicted down to 10 entries, has %d", name, cache.Len())
+		}
+
+		for _, key := range skewedTrace(1000) {
+			if _, ok := cache.Get(key); !ok {
+				cache.Set(key, key, 0)
+			}
+		}
+		if cache.Len() != 10 {
+			t.Errorf("%s: should stay within the new capacity, has %d", name, cache.Len())
+		}
+	}
+}
+
+func TestMemCacheInspect(t *testing.T) {
+	cache := newMemoryCache(10)
+	before := time.Now()
+	cache.Set("k1", &redisCacheEntry{value: []byte("v1"), keyHashSlot: 12}, time.Hour)
+
+	info, ok := cache.Inspect("k1")
+	if !ok {
+		t.Fatalf("Failed to inspect entry")
+	}
+	if info.Created.Before(before) || !info.Updated.Equal(info.Created) {
+		t.Errorf("Should record creation time, got %v and %v", info.Created, info.Updated)
+	}
+	if !info.LastAccess.IsZero() || info.Hits != 0 {
+		t.Errorf("Should not have been accessed, got %v and %d hits", info.LastAccess, info.Hits)
+	}
+	if info.TTL <= 59*time.Minute || info.TTL > time.Hour {
+		t.Errorf("Should report TTL remaining, got %v", info.TTL)
+	}
+	if info.Slot != 12 || info.Cost != 4 {
+		t.Errorf("Should report slot and cost, got %d and %d", info.Slot, info.Cost)
+	}
+
+	time.Sleep(time.Millisecond)
+	cache.Get("k1")
+	cache.Get("k1")
+	cache.Set("k1", &redisCacheEntry{value: []byte("v2")}, 0)
+	cache.Get("k1")
+
+	updated, _ := cache.Inspect("k1")
+	if !updated.Created.Equal(info.Created) || !updated.Updated.After(info.Updated) {
+		t.Errorf("Should keep creation time and record update time")
+	}
+	if updated.Hits != 1 || updated.LastAccess.Before(updated.Updated) {
+		t.Errorf("Should count accesses since the last update, got %d", updated.Hits)
+	}
+	if updated.TTL != 0 {
+		t.Errorf("Should report no TTL, got %v", updated.TTL)
+	}
+
+	if _, ok := cache.Inspect("missing"); ok {
+		t.Errorf("Should not inspect missing key")
+	}
+}
+
+func TestMemCacheSetExpiry(t *testing.T) {
+	cache := newMemoryCache(10, WithShards(1))
+	cache.Set("k1", "v1", time.Hour)
+	cache.Get("k1")
+
+	if !cache.setExpiry("k1", time.Now().Add(time.Minute), time.Time{}) {
+		t.Fatalf("Failed to set expiry")
+	}
+	value, ttl, ok := cache.getWithTTL("k1")
+	if !ok || value != "v1" || ttl <= 59*time.Second || ttl > time.Minute {
+		t.Errorf("Should keep value with the new TTL, got %v and %v", value, ttl)
+	}
+	if info, _ := cache.Inspect("k1"); info.Hits != 2 {
+		t.Errorf("Should keep metadata, got %d hits", info.Hits)
+	}
+
+	cache.setExpiry("k1", time.Time{}, time.Time{})
+	if _, ttl, _ := cache.getWithTTL("k1"); ttl != 0 || len(cache.shards[0].expiries) != 0 {
+		t.Errorf("Should make the entry never expire, got %v", ttl)
+	}
+
+	cache.setExpiry("k1", time.Now().Add(-time.Second), time.Time{})
+	if _, ok := cache.Get("k1"); ok || cache.Len() != 0 {
+		t.Errorf("Should remove entries expiring in the past")
+	}
+	if cache.setExpiry("missing", time.Time{}, time.Time{}) {
+		t.Errorf("Should not set expiry of missing key")
+	}
+
+	// Redis cache entries are told when their key expires in redis.
+	keyExpiresAt := time.Now().Add(time.Hour)
+	cache.Set("entry", &redisCacheEntry{value: []byte("v"), expiresAt: time.Now().Add(time.Minute).UnixNano()}, time.Minute)
+	cache.setExpiry("entry", time.Now().Add(time.Second), keyExpiresAt)
+	if value, _ := cache.Get("entry"); value.(*redisCacheEntry).expiresAt != keyExpiresAt.UnixNano() {
+		t.Errorf("Should change when the key expires in redis, got %v", value.(*redisCacheEntry).expiresAt)
+	}
+}
+
+type rejectingPolicy struct {
+	EvictionPolicy
+}
+
+func (rejectingPolicy) ShouldAddEntry(key string, value interface{}) bool {
+	return false
+}
+
+type forgetfulPolicy struct {
+	EvictionPolicy
+}
+
+func (forgetfulPolicy) ShouldKeepEntry(key string, value interface{}) bool {
+	return false
+}
+
+func TestMemCacheEvictionPolicyAdmission(t *testing.T) {
+	cache := newMemoryCache(10, WithEvictionPolicy(func(capacity int64) EvictionPolicy {
+		return rejectingPolicy{NewLRUPolicy(capacity)}
+	}))
+
+	for i := 0; i < 15; i++ {
+		cache.Set(fmt.Sprintf("%d", i), i, 0)
+	}
+
+	if cache.Len() != 10 {
+		t.Errorf("Failed to evict entries")
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, ok := cache.Get(fmt.Sprintf("%d", i)); !ok {
+			t.Errorf("Should have kept entries added before the cache was full")
+		}
+	}
+
+	for i := 10; i < 15; i++ {
+		if _, ok := cache.Get(fmt.Sprintf("%d", i)); ok {
+			t.Errorf("Should not have admitted entries refused by the policy")
+		}
+	}
+}
+
+func TestMemCacheEvictionPolicyRetention(t *testing.T) {
+	cache := newMemoryCache(10, WithEvictionPolicy(func(capacity int64) EvictionPolicy {
+		return forgetfulPolicy{NewLRUPolicy(capacity)}
+	}))
+
+	cache.Set("k1", "v1", 0)
+	if _, ok := cache.Get("k1"); !ok {
+		t.Errorf("Should return entry before the access is applied")
+	}
+
+	// Accesses are applied on the next write.
+	cache.Set("k2", "v2", 0)
+	if cache.Len() != 1 {
+		t.Errorf("Failed to remove discarded entry")
+	}
+	if _, ok := cache.Get("k1"); ok {
+		t.Errorf("Should have discarded entry on access")
+	}
+}
+
+func TestMemCacheGetAppliesAccessesInBatches(t *testing.T) {
+	cache := newMemoryCache(10, WithEvictionPolicy(func(capacity int64) EvictionPolicy {
+		return forgetfulPolicy{NewLRUPolicy(capacity)}
+	}))
+
+	cache.Set("k1", "v1", 0)
+	for i := 0; i < accessStripeDrainThreshold; i++ {
+		cache.Get("k1")
+	}
+
+	// Filling the stripe drained it without waiting for a write.
+	if cache.Len() != 0 {
+		t.Errorf("Failed to apply buffered accesses")
+	}
+}
+
+func TestMemCacheGetPromotesBeforeEviction(t *testing.T) {
+	cache := newMemoryCache(3)
+
+	cache.Set("k1", "v1", 0)
+	cache.Set("k2", "v2", 0)
+	cache.Set("k3", "v3", 0)
+	cache.Get("k1")
+	cache.Set("k4", "v4", 0)
+
+	if _, ok := cache.Get("k1"); !ok {
+		t.Errorf("Should have kept recently accessed entry")
+	}
+	if _, ok := cache.Get("k2"); ok {
+		t.Errorf("Should have evicted least recently used entry")
+	}
+}
+
+func TestMemCacheEvictByCost(t *testing.T) {
+	cache := newMemoryCache(100, WithMaxCost(100))
+
+	for i := 0; i < 10; i++ {
+		// Each entry costs 2 bytes of key and 18 bytes of value.
+		cache.Set(fmt.Sprintf("k%d", i), fmt.Sprintf("%018d", i), 0)
+	}
+
+	if cache.Len() != 5 {
+		t.Errorf("Should have kept 5 entries within the maximum cost, kept %d", cache.Len())
+	}
+	if cache.Cost() != 100 {
+		t.Errorf("Total cost should be 100, got %d", cache.Cost())
+	}
+
+	for i := 5; i < 10; i++ {
+		if _, ok := cache.Get(fmt.Sprintf("k%d", i)); !ok {
+			t.Errorf("Should have kept the most recent entries")
+		}
+	}
+
+	// Growing an entry evicts others.
+	cache.Set("k9", fmt.Sprintf("%058d", 9), 0)
+	if cache.Cost() > 100 {
+		t.Errorf("Total cost should not exceed 100, got %d", cache.Cost())
+	}
+	if _, ok := cache.Get("k9"); !ok {
+		t.Errorf("Should have kept the updated entry")
+	}
+}
+
+func TestMemCacheRefusesLargeEntries(t *testing.T) {
+	cache := newMemoryCache(100, WithMaxCost(100), WithMaxEntryCostRatio(0.5))
+
+	cache.Set("k1", "v1", 0)
+	cache.Set("k2", fmt.Sprintf("%060d", 2), 0)
+	if _, ok := cache.Get("k2"); ok {
+		t.Errorf("Should have refused entry larger than half the maximum cost")
+	}
+	if _, ok := cache.Get("k1"); !ok {
+		t.Errorf("Should not have evicted entries for a refused entry")
+	}
+
+	// Replacing a value with a too large one drops the old value.
+	cache.Set("k1", fmt.Sprintf("%060d", 1), 0)
+	if _, ok := cache.Get("k1"); ok {
+		t.Errorf("Should have dropped entry replaced by a too large value")
+	}
+	if cache.Cost() != 0 {
+		t.Errorf("Total cost should be 0, got %d", cache.Cost())
+	}
+}
+
+func TestMemCacheEntryCostRatioWithShards(t *testing.T) {
+	// Enough entries for several shards to be picked automatically.
+	cache := newMemoryCache(1<<20, WithMaxCost(1000), WithMaxEntryCostRatio(0.5))
+	if len(cache.shards) > 2 {
+		t.Errorf("Should have used at most 2 shards, got %d", len(cache.shards))
+	}
+	cache.Set("k1", fmt.Sprintf("%0400d", 1), 0)
+	if _, ok := cache.Get("k1"); !ok {
+		t.Errorf("Should have cached entry below the maximum entry cost")
+	}
+
+	cache = newMemoryCache(1<<20, WithMaxCost(1001), WithShards(8))
+	total := int64(0)
+	for _, shard := range cache.shards {
+		total += shard.maxCost
+	}
+	if total > 1001 {
+		t.Errorf("Shard budgets should not exceed the maximum cost, got %d", total)
+	}
+}
+
+func TestMemCacheWeigher(t *testing.T) {
+	cache := newMemoryCache(100, WithMaxCost(10), WithWeigher(func(key string, value []byte) int64 {
+		return 5
+	}))
+
+	for i := 0; i < 5; i++ {
+		cache.Set(fmt.Sprintf("%d", i), i, 0)
+	}
+
+	if cache.Len() != 2 {
+		t.Errorf("Should have kept 2 entries weighing 5 each, kept %d", cache.Len())
+	}
+}
+
+func TestMemCacheShards(t *testing.T) {
+	cache := newMemoryCache(1000, WithShards(3))
+	if len(cache.shards) != 4 {
+		t.Errorf("Should have rounded shards up to 4, got %d", len(cache.shards))
+	}
+	for _, shard := range cache.shards {
+		if shard.maxEntries.Load() != 250 {
+			t.Errorf("Each shard should hold 250 entries, got %d", shard.maxEntries.Load())
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		cache.Set(fmt.Sprintf("%d", i), i, 0)
+	}
+	if cache.Len() != 100 {
+		t.Errorf("Failed to add entries")
+	}
+	for _, shard := range cache.shards {
+		if shard.numEntries.Load() == 0 {
+			t.Errorf("Entries should be spread across shards")
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if val, ok := cache.Get(fmt.Sprintf("%d", i)); !ok || val != i {
+			t.Errorf("Failed to get entry")
+		}
+	}
+}
+
+func TestMemCacheDefaultShards(t *testing.T) {
+	if n := len(newMemoryCache(100).shards); n != 1 {
+		t.Errorf("Small caches should not be sharded, got %d shards", n)
+	}
+	if n := defaultShardCount(1 << 20); n < uint64(runtime.GOMAXPROCS(0)) {
+		t.Errorf("Large caches should have at least one shard per CPU, got %d shards", n)
+	}
+}
+
+func benchmarkMemCacheParallel(b *testing.B, shards int, writeEvery int) {
+	cache := newMemoryCache(100000, WithShards(shards))
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%d", i)
+		cache.Set(keys[i], i, 0)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for i := 0; pb.Next(); i++ {
+			key := keys[r.Intn(len(keys))]
+			if writeEvery > 0 && i%writeEvery == 0 {
+				cache.Set(key, i, 0)
+			} else {
+				cache.Get(key)
+			}
+		}
+	})
+}
+
+// Run with -cpu 1,2,4,8 to see how throughput scales with GOMAXPROCS.
+func BenchmarkMemCacheGetParallel(b *testing.B) {
+	b.Run("shards=1", func(b *testing.B) { benchmarkMemCacheParallel(b, 1, 0) })
+	b.Run("shards=default", func(b *testing.B) { benchmarkMemCacheParallel(b, 0, 0) })
+}
+
+func BenchmarkMemCacheMixedParallel(b *testing.B) {
+	b.Run("shards=1", func(b *testing.B) { benchmarkMemCacheParallel(b, 1, 10) })
+	b.Run("shards=default", func(b *testing.B) { benchmarkMemCacheParallel(b, 0, 10) })
+}
+
+// Inserting into a full cache should take about the same time whatever its
+// size, as expired entries are found without scanning the cache.
+func BenchmarkMemCacheSetFull(b *testing.B) {
+	for _, size := range []int{10000, 100000, 1000000} {
+		b.Run(fmt.Sprintf("entries=%d", size), func(b *testing.B) {
+			cache := newMemoryCache(int64(size))
+			for i := 0; i < size; i++ {
+				cache.Set(fmt.Sprintf("%d", i), i, time.Hour)
+			}
+			keys := make([]string, b.N)
+			for i := range keys {
+				keys[i] = fmt.Sprintf("new-%d", i)
+			}
+
+			b.ResetTimer()
+			for i, key := range keys {
+				cache.Set(key, i, time.Hour)
+			}
+		})
+	}
+}
+
+// policyHitRatio replays the trace directly against a policy, applying every
+// access synchronously.
+func policyHitRatio(policy EvictionPolicy, capacity int, trace []string) float64 {
+	hits := 0
+	keys := map[string]bool{}
+	for _, key := range trace {
+		if keys[key] {
+			policy.ShouldKeepEntry(key, key)
+			hits++
+			continue
+		}
+		if !policy.ShouldAddEntry(key, key) {
+			continue
+		}
+		if len(keys) >= capacity {
+			victim, _ := policy.Victim()
+			delete(keys, victim)
+			policy.EntryRemoved(victim)
+		}
+		keys[key] = true
+		policy.EntryAdded(key, key)
+	}
+	return float64(hits) / float64(len(trace))
+}
+
+func TestMemCacheBufferedAccessesKeepHitRatio(t *testing.T) {
+	trace := skewedTrace(50000)
+	policies := map[string]func(capacity int64) EvictionPolicy{
+		"LRU": NewLRUPolicy,
+		"LFU": NewLFUPolicy,
+		// Both TinyLFU runs use the same sketch seed, so that their hit
+		// ratios don't differ because of sketch collisions.
+		"TinyLFU": func(capacity int64) EvictionPolicy { return newTinyLFUPolicy(capacity, 1) },
+	}
+	for name, newPolicy := range policies {
+		buffered := hitRatio(newMemoryCache(500, WithShards(1), WithEvictionPolicy(newPolicy)), trace)
+		synchronous := policyHitRatio(newPolicy(500), 500, trace)
+		if buffered < synchronous-0.02 {
+			t.Errorf("%s: hit ratio dropped from %.2f%% to %.2f%% with buffered accesses", name, 100*synchronous, 100*buffered)
+		}
+	}
+}
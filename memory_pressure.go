@@ -0,0 +1,98 @@
+package hypercache
+
+import (
+	"math"
+	"runtime/debug"
+	"runtime/metrics"
+	"time"
+)
+
+const (
+	// Entries are shed while the heap usage is above this fraction of the
+	// ceiling, and the capacity recovers once it's below the low one.
+	memoryHighWatermark = 0.9
+	memoryLowWatermark  = 0.75
+	// Fraction of the entries shed, and of the configured capacity
+	// recovered, on every check.
+	memoryShedRatio    = 0.1
+	memoryRecoverRatio = 0.1
+
+	// Heap occupied by live objects as of the last GC, available since
+	// Go 1.21.
+	heapLiveMetric = "/gc/heap/live:bytes"
+	// Heap occupied by objects, including garbage not yet swept, for older
+	// runtimes.
+	heapObjectsMetric = "/memory/classes/heap/objects:bytes"
+)
+
+// heapUsage returns the memory occupied by live heap objects, as measured by
+// the last GC. Garbage allocated since then isn't counted, as it would make
+// the cache shed entries right before the GC reclaims it. Runtimes that
+// don't report the live heap fall back to every heap object.
+func heapUsage() uint64 {
+	sample := []metrics.Sample{{Name: heapLiveMetric}, {Name: heapObjectsMetric}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() == metrics.KindUint64 {
+		return sample[0].Value.Uint64()
+	}
+	return sample[1].Value.Uint64()
+}
+
+// memoryCeiling returns the configured ceiling, or the runtime memory limit
+// if there is none. It returns false if neither is set.
+func memoryCeiling(ceiling int64) (uint64, bool) {
+	if ceiling > 0 {
+		return uint64(ceiling), true
+	}
+	// A negative value reads the limit without changing it.
+	limit := debug.SetMemoryLimit(-1)
+	if limit == math.MaxInt64 {
+		return 0, false
+	}
+	return uint64(limit), true
+}
+
+// watchMemory adapts the capacity to the heap usage every interval until the
+// cache is closed.
+func (mc *memoryCache) watchMemory(interval time.Duration, ceiling int64) {
+	defer mc.background.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-mc.stop:
+			return
+		case <-ticker.C:
+			if limit, ok := memoryCeiling(ceiling); ok {
+				mc.adaptToMemoryPressure(heapUsage(), limit)
+			}
+		}
+	}
+}
+
+// adaptToMemoryPressure sheds entries if the heap usage is above the high
+// watermark, and lets the capacity grow back to the configured one once it's
+// below the low watermark.
+func (mc *memoryCache) adaptToMemoryPressure(heap, ceiling uint64) {
+	mc.resizeMu.Lock()
+	defer mc.resizeMu.Unlock()
+	capacity := mc.maxEntries.Load()
+	switch {
+	case float64(heap) > memoryHighWatermark*float64(ceiling):
+		entries := mc.Len()
+		target := entries - int64(math.Ceil(memoryShedRatio*float64(entries)))
+		if target < 1 {
+			target = 1
+		}
+		if target < capacity {
+			logDebug("Heap usage %d above %.0f%% of %d, shedding down to %d entries", heap, 100*memoryHighWatermark, ceiling, target)
+			mc.resize(target)
+		}
+	case float64(heap) < memoryLowWatermark*float64(ceiling) && capacity < mc.configuredEntries:
+		target := capacity + int64(math.Ceil(memoryRecoverRatio*float64(mc.configuredEntries)))
+		if target > mc.configuredEntries {
+			target = mc.configuredEntries
+		}
+		mc.resize(target)
+	}
+}
@@ -0,0 +1,119 @@
+package hypercache
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"testing"
+	"time"
+)
+
+func waitForLen(cache *memoryCache, n int64) {
+	for i := 0; i < 100 && cache.Len() > n; i++ {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMemCacheShedsUnderMemoryPressure(t *testing.T) {
+	cache := newMemoryCache(100, WithShards(1))
+	for i := 0; i < 100; i++ {
+		cache.Set(fmt.Sprintf("%d", i), i, 0)
+	}
+
+	// Above the high watermark, 10% of the entries are shed per check.
+	cache.adaptToMemoryPressure(95, 100)
+	waitForLen(cache, 90)
+	if cache.Capacity() != 90 || cache.Len() != 90 {
+		t.Errorf("Should have shed down to 90 entries, capacity %d, has %d", cache.Capacity(), cache.Len())
+	}
+	cache.adaptToMemoryPressure(95, 100)
+	waitForLen(cache, 81)
+	if cache.Capacity() != 81 || cache.Len() != 81 {
+		t.Errorf("Should have shed down to 81 entries, capacity %d, has %d", cache.Capacity(), cache.Len())
+	}
+
+	// Between the watermarks, the capacity holds.
+	cache.adaptToMemoryPressure(80, 100)
+	if cache.Capacity() != 81 {
+		t.Errorf("Capacity should hold between watermarks, got %d", cache.Capacity())
+	}
+
+	// Below the low watermark, 10% of the configured capacity is recovered
+	// per check.
+	cache.adaptToMemoryPressure(50, 100)
+	if cache.Capacity() != 91 {
+		t.Errorf("Capacity should recover to 91, got %d", cache.Capacity())
+	}
+	cache.adaptToMemoryPressure(50, 100)
+	if cache.Capacity() != 100 {
+		t.Errorf("Capacity should recover up to the configured one, got %d", cache.Capacity())
+	}
+}
+
+func TestMemCacheResizeUnderMemoryPressure(t *testing.T) {
+	cache := newMemoryCache(100, WithShards(1))
+	for i := 0; i < 100; i++ {
+		cache.Set(fmt.Sprintf("%d", i), i, 0)
+	}
+	cache.adaptToMemoryPressure(95, 100)
+
+	// Capacity recovers up to the size set by Resize.
+	cache.Resize(50)
+	waitForLen(cache, 50)
+	for i := 0; i < 20; i++ {
+		cache.adaptToMemoryPressure(0, 100)
+	}
+	if cache.Capacity() != 50 {
+		t.Errorf("Capacity should recover up to 50, got %d", cache.Capacity())
+	}
+}
+
+func TestMemoryCeiling(t *testing.T) {
+	if ceiling, ok := memoryCeiling(1000); !ok || ceiling != 1000 {
+		t.Errorf("Should use the configured ceiling, got %d", ceiling)
+	}
+
+	previous := debug.SetMemoryLimit(math.MaxInt64)
+	defer debug.SetMemoryLimit(previous)
+	if _, ok := memoryCeiling(0); ok {
+		t.Errorf("Should not have a ceiling without memory limit")
+	}
+
+	debug.SetMemoryLimit(1 << 30)
+	if ceiling, ok := memoryCeiling(0); !ok || ceiling != 1<<30 {
+		t.Errorf("Should use the runtime memory limit, got %d", ceiling)
+	}
+}
+
+func TestMemCacheWatchMemory(t *testing.T) {
+	// Any heap is above a 1 byte ceiling.
+	cache := newMemoryCache(100, WithMemoryPressure(1, time.Millisecond))
+	for i := 0; i < 100; i++ {
+		cache.Set(fmt.Sprintf("%d", i), i, 0)
+	}
+	// The live heap is only measured by the GC.
+	runtime.GC()
+
+	time.Sleep(50 * time.Millisecond)
+	cache.Close()
+	if cache.Capacity() >= 100 || cache.Len() >= 100 {
+		t.Errorf("Should have shed entries, capacity %d, has %d", cache.Capacity(), cache.Len())
+	}
+}
+
+var garbageSink []byte
+
+func TestHeapUsageIgnoresUncollectedGarbage(t *testing.T) {
+	// Keep the GC from collecting the garbage while it's measured.
+	defer debug.SetGCPercent(debug.SetGCPercent(-1))
+	runtime.GC()
+	before := heapUsage()
+	for i := 0; i < 64; i++ {
+		garbageSink = make([]byte, 1<<20)
+	}
+	garbageSink = nil
+	if after := heapUsage(); after > before+1<<20 {
+		t.Errorf("Should not have counted garbage, heap usage went from %d to %d", before, after)
+	}
+}
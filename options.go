@@ -0,0 +1,406 @@
+package hypercache
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Option configures a synchronized cache.
+type Option func(*options)
+
+type options struct {
+	// Codec used for keys that don't belong to any namespace.
+	codec Codec
+	// Codecs overriding the default one for keys starting with a prefix.
+	namespaceCodecs map[string]Codec
+	// Whether values are written with an envelope header.
+	envelope bool
+	// Algorithm used to compress values of at least compressionThreshold bytes.
+	compression          Compression
+	compressionThreshold int
+	// Algorithm used to checksum values.
+	checksum Checksum
+	// Keys used to encrypt values, the first one encrypts new values.
+	encryptionKeys []EncryptionKey
+	// Creates the eviction policy of the in-memory cache.
+	newPolicy func(capacity int64) EvictionPolicy
+	// Maximum total cost of the in-memory cache entries, or 0 if unbounded.
+	maxCost int64
+	// Fraction of the maximum cost a single entry may cost.
+	maxEntryCostRatio float64
+	// Returns the cost of an in-memory cache entry.
+	weigher Weigher
+	// Number of shards of the in-memory cache, or 0 to pick it
+	// automatically.
+	shards int
+	// Interval between runs of the janitor, or 0 if disabled.
+	janitorInterval time.Duration
+	// Maximum number of entries the janitor removes per run, or 0 if
+	// unbounded.
+	janitorBudget int
+	// Called with the entries removed from the in-memory cache.
+	onRemoval RemovalListener
+	// Interval between heap usage checks, or 0 if disabled.
+	memoryCheckInterval time.Duration
+	// Heap size the in-memory cache must stay under, or 0 to use the
+	// runtime memory limit.
+	memoryCeiling int64
+	// Total size of the arenas storing the in-memory cache entries, or 0
+	// to store them as individual objects.
+	arenaSize int64
+	// Minimum time between TTL extensions of sliding keys by reads, or 0
+	// for a tenth of their window.
+	slidingRefreshInterval time.Duration
+	// Maximum time entries are kept in memory without being read again
+	// from redis, or 0 if they're kept as long as their key.
+	maxLocalTTL time.Duration
+	// Extends the TTLs of written keys.
+	jitter ttlJitter
+	// Whether values are written with a version.
+	versioning bool
+}
+
+// Weigher returns the cost of an in-memory cache entry, given its key and
+// serialized value.
+type Weigher func(key string, value []byte) int64
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		codec:             MsgpackCodec{},
+		namespaceCodecs:   map[string]Codec{},
+		newPolicy:         NewLRUPolicy,
+		maxEntryCostRatio: 1,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithCodec sets the codec used to encode values stored by the cache.
+func WithCodec(codec Codec) Option {
+	return func(o *options) {
+		o.codec = codec
+	}
+}
+
+// WithNamespaceCodec overrides the codec for keys starting with the given
+// prefix. When several prefixes match a key, the longest one wins.
+func WithNamespaceCodec(prefix string, codec Codec) Option {
+	return func(o *options) {
+		o.namespaceCodecs[prefix] = codec
+	}
+}
+
+// WithEnvelope prefixes stored values with a header recording the codec and
+// format version that produced them. Values are only written with a header
+// when this option is set, but enveloped values are recognized by their magic
+// bytes and decoded with the codec in their header on every instance. This
+// allows migrating codecs while old and new instances are running side by
+// side.
+func WithEnvelope() Option {
+	return func(o *options) {
+		o.envelope = true
+	}
+}
+
+// WithCompression compresses values whose encoded size is at least threshold
+// bytes. Compressed values are flagged in their envelope and decompressed
+// transparently on read, so this option implies WithEnvelope.
+func WithCompression(compression Compression, threshold int) Option {
+	return func(o *options) {
+		o.compression = compression
+		o.compressionThreshold = threshold
+	}
+}
+
+// WithChecksum appends a checksum to stored values, which is verified when
+// they are read. Corrupted values are treated as a miss and deleted. This
+// option implies WithEnvelope.
+func WithChecksum(checksum Checksum) Option {
+	return func(o *options) {
+		o.checksum = checksum
+	}
+}
+
+// WithEncryption encrypts stored values with AES-GCM using the current key.
+// Values encrypted with any of the previous keys can still be decrypted,
+// which allows rotating keys without dropping existing entries. It panics if
+// a key has an invalid size or if two keys share an id.
+func WithEncryption(current EncryptionKey, previous ...EncryptionKey) Option {
+	keys := append([]EncryptionKey{current}, previous...)
+	if _, err := newAEADs(keys); err != nil {
+		panic(err.Error())
+	}
+	return func(o *options) {
+		o.encryptionKeys = keys
+	}
+}
+
+// WithEvictionPolicy sets the eviction policy of the in-memory cache. The
+// given function is called with the maximum number of entries of the cache,
+// e.g. WithEvictionPolicy(NewLRUPolicy).
+func WithEvictionPolicy(newPolicy func(capacity int64) EvictionPolicy) Option {
+	return func(o *options) {
+		o.newPolicy = newPolicy
+	}
+}
+
+// WithMaxCost bounds the total cost of the in-memory cache entries, in
+// addition to their number. By default, the cost of an entry is the size of
+// its key and serialized value in bytes.
+func WithMaxCost(maxCost int64) Option {
+	return func(o *options) {
+		o.maxCost = maxCost
+	}
+}
+
+// WithMaxEntryCostRatio prevents entries costing more than the given
+// fraction of the maximum cost from being added to the in-memory cache.
+// They are still stored in redis. Each shard gets an equal share of the
+// maximum cost, so when the number of shards is picked automatically, it is
+// kept low enough for a shard to hold such an entry. With WithShards, entries
+// are also bounded by the share of a shard.
+func WithMaxEntryCostRatio(ratio float64) Option {
+	return func(o *options) {
+		o.maxEntryCostRatio = ratio
+	}
+}
+
+// WithWeigher sets the function computing the cost of in-memory cache
+// entries, counted against the maximum cost.
+func WithWeigher(weigher Weigher) Option {
+	return func(o *options) {
+		o.weigher = weigher
+	}
+}
+
+// WithShards splits the in-memory cache into the given number of shards,
+// rounded up to a power of two. Each shard has its own lock, eviction policy
+// and share of the capacity. By default, the number of shards grows with
+// GOMAXPROCS as long as each shard holds at least 256 entries, and its share
+// of the maximum cost fits the maximum entry cost.
+func WithShards(shards int) Option {
+	return func(o *options) {
+		o.shards = shards
+	}
+}
+
+// WithJanitor starts a goroutine removing expired entries from the in-memory
+// cache every interval, so that they don't hold memory until they're looked
+// up or evicted. At most budget entries are removed per run, or all expired
+// entries if budget is 0. The goroutine stops when the cache is closed.
+func WithJanitor(interval time.Duration, budget int) Option {
+	if interval <= 0 {
+		panic("cache: janitor interval must be positive")
+	}
+	return func(o *options) {
+		o.janitorInterval = interval
+		o.janitorBudget = budget
+	}
+}
+
+// WithOnRemoval calls the listener whenever an entry leaves the in-memory
+// cache, with the reason why. The listener is called after internal locks
+// are released, so it may use the cache. For synchronized caches, the value
+// is the serialized value.
+func WithOnRemoval(listener RemovalListener) Option {
+	return func(o *options) {
+		o.onRemoval = listener
+	}
+}
+
+// WithMemoryPressure checks the heap usage every interval, and sheds entries
+// from the in-memory cache while it's above 90% of the ceiling. The capacity
+// recovers gradually once the heap usage is back under 75% of the ceiling.
+// If ceiling is 0, the runtime memory limit set by debug.SetMemoryLimit or
+// GOMEMLIMIT is used, and nothing is shed if there is none. The heap usage
+// is the size of the live heap as of the last GC. The goroutine checking the
+// heap usage stops when the cache is closed. This option has no effect with
+// WithArenaStorage, whose buffers are allocated up front.
+func WithMemoryPressure(ceiling int64, interval time.Duration) Option {
+	if interval <= 0 {
+		panic("cache: memory check interval must be positive")
+	}
+	return func(o *options) {
+		o.memoryCeiling = ceiling
+		o.memoryCheckInterval = interval
+	}
+}
+
+// WithArenaStorage stores the in-memory cache entries in pre-allocated ring
+// buffers of the given total size, split between shards, instead of one
+// object per entry. The garbage collector doesn't scan them, which keeps its
+// cost flat with millions of entries. Entries are evicted in insertion order
+// when a buffer is full or holds the maximum number of entries; eviction
+// policies, costs, the janitor and memory pressure don't apply.
+func WithArenaStorage(size int64) Option {
+	if size <= 0 {
+		panic("cache: arena size must be positive")
+	}
+	return func(o *options) {
+		o.arenaSize = size
+	}
+}
+
+// WithSlidingRefresh sets how often reads of keys written with
+// WithSlidingExpiration extend their TTL in redis, so that every read
+// doesn't become a write. It defaults to a tenth of their window, and is
+// capped to half of it.
+func WithSlidingRefresh(interval time.Duration) Option {
+	if interval <= 0 {
+		panic("cache: sliding refresh interval must be positive")
+	}
+	return func(o *options) {
+		o.slidingRefreshInterval = interval
+	}
+}
+
+// WithMaxLocalTTL bounds how long entries are kept in memory without being
+// read again from redis, whatever the TTL of their key. It bounds how long a
+// stale value may be served when an update notification is lost, as a
+// safety net behind them.
+func WithMaxLocalTTL(ttl time.Duration) Option {
+	if ttl <= 0 {
+		panic("cache: maximum local TTL must be positive")
+	}
+	return func(o *options) {
+		o.maxLocalTTL = ttl
+	}
+}
+
+// WithTTLJitter extends the TTL of keys written by Set by a random duration
+// of up to the given fraction of it, so that keys written together with the
+// same TTL don't all expire at once. Sliding keys are only jittered until
+// their first read, which extends them by the TTL they were written with.
+// It replaces WithTTLJitterRange.
+func WithTTLJitter(ratio float64) Option {
+	if ratio <= 0 {
+		panic("cache: TTL jitter ratio must be positive")
+	}
+	return func(o *options) {
+		o.jitter.ratio = ratio
+		o.jitter.max = 0
+	}
+}
+
+// WithTTLJitterRange extends the TTL of keys written by Set by a random
+// duration of up to max, so that keys written together with the same TTL
+// don't all expire at once. Like WithTTLJitter, it doesn't apply to the
+// window of sliding keys. It replaces WithTTLJitter.
+func WithTTLJitterRange(max time.Duration) Option {
+	if max <= 0 {
+		panic("cache: TTL jitter range must be positive")
+	}
+	return func(o *options) {
+		o.jitter.max = max
+		o.jitter.ratio = 0
+	}
+}
+
+// WithDeterministicJitter derives the TTL jitter of keys from their name
+// rather than randomly, so that a key written with a given TTL always gets
+// the same one, on every instance.
+func WithDeterministicJitter() Option {
+	return func(o *options) {
+		o.jitter.deterministic = true
+	}
+}
+
+// WithVersioning writes values with a version, bumped atomically on every
+// write, which GetVersioned and CompareAndSet rely on. Versioned values are
+// prefixed with a header in redis, so clients reading the keys directly must
+// skip it. Versions are compared as bytes in redis, so the whole uint64 range
+// is usable. Every instance writing the keys should enable it, as writes
+// without versioning reset the version of a key to 0.
+func WithVersioning() Option {
+	return func(o *options) {
+		o.versioning = true
+	}
+}
+
+// SetOption configures a single write to the cache.
+type SetOption func(*setOptions)
+
+type setOptions struct {
+	// Whether reads extend the TTL of the key.
+	sliding bool
+	// Maximum time the written entry is kept in memory, or 0 to use the
+	// one of the cache.
+	localTTL time.Duration
+}
+
+func newSetOptions(opts []SetOption) *setOptions {
+	o := &setOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithSlidingExpiration makes the key expire once it hasn't been read for
+// its TTL, rather than its TTL after it was written: reads extend it back
+// to the full TTL, in redis and in memory. It has no effect on keys without
+// a TTL.
+func WithSlidingExpiration() SetOption {
+	return func(o *setOptions) {
+		o.sliding = true
+	}
+}
+
+// WithLocalTTL keeps the written entry in memory no longer than the given
+// TTL, instead of the one set by WithMaxLocalTTL. Once read again from redis,
+// the entry is bounded by the TTL of the cache again.
+func WithLocalTTL(ttl time.Duration) SetOption {
+	if ttl <= 0 {
+		panic("cache: local TTL must be positive")
+	}
+	return func(o *setOptions) {
+		o.localTTL = ttl
+	}
+}
+
+// newSerde creates the serde used to store values encoded with the given codec.
+func (o *options) newSerde(codec Codec, stats *cacheStats) (serde, error) {
+	var s serde = newDefaultSerde(codec, o, stats)
+	if len(o.encryptionKeys) > 0 {
+		es, err := newEncryptingSerde(s, o.encryptionKeys[0], o.encryptionKeys[1:])
+		if err != nil {
+			return nil, err
+		}
+		s = es
+	}
+	return s, nil
+}
+
+type namespaceSerde struct {
+	prefix string
+	serde  serde
+}
+
+// namespaceSerdes returns a serde for every namespace codec, sorted so that
+// longer prefixes come first.
+func (o *options) namespaceSerdes(stats *cacheStats) ([]namespaceSerde, error) {
+	serdes := make([]namespaceSerde, 0, len(o.namespaceCodecs))
+	for prefix, codec := range o.namespaceCodecs {
+		s, err := o.newSerde(codec, stats)
+		if err != nil {
+			return nil, err
+		}
+		serdes = append(serdes, namespaceSerde{prefix: prefix, serde: s})
+	}
+	sort.Slice(serdes, func(i, j int) bool {
+		return len(serdes[i].prefix) > len(serdes[j].prefix)
+	})
+	return serdes, nil
+}
+
+func findNamespaceSerde(serdes []namespaceSerde, key string) (serde, bool) {
+	for _, ns := range serdes {
+		if strings.HasPrefix(key, ns.prefix) {
+			return ns.serde, true
+		}
+	}
+	return nil, false
+}
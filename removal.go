@@ -0,0 +1,43 @@
+package hypercache
+
+// RemovalReason tells why an entry left the in-memory cache.
+type RemovalReason int
+
+const (
+	// The entry outlived its TTL.
+	RemovalExpired RemovalReason = iota
+	// The entry was evicted to make room for others, or the eviction policy
+	// decided not to keep it.
+	RemovalEvicted
+	// The entry was updated by another instance.
+	RemovalInvalidated
+	// The entry was deleted.
+	RemovalDeleted
+	// The entry was overwritten by a new value.
+	RemovalReplaced
+)
+
+func (r RemovalReason) String() string {
+	switch r {
+	case RemovalExpired:
+		return "expired"
+	case RemovalEvicted:
+		return "evicted"
+	case RemovalInvalidated:
+		return "invalidated"
+	case RemovalDeleted:
+		return "deleted"
+	case RemovalReplaced:
+		return "replaced"
+	}
+	return "unknown"
+}
+
+// RemovalListener is called with the key and value of entries leaving the
+// in-memory cache, and the reason why.
+type RemovalListener func(key string, value interface{}, reason RemovalReason)
+
+type removal struct {
+	entry  *cacheEntry
+	reason RemovalReason
+}
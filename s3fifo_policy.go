@@ -0,0 +1,128 @@
+package hypercache
+
+// Access counters of S3-FIFO saturate at 3.
+const s3FIFOMaxFreq = 3
+
+/*
+ * s3FIFOPolicy implements S3-FIFO, which only uses FIFO queues. New entries
+ * go to the small queue, and are evicted from it unless they were accessed
+ * while there, in which case they move to the main queue. Keys evicted from
+ * the small queue are remembered in the ghost queue, and go straight to the
+ * main queue if added again. Entries leaving the main queue are reinserted
+ * as long as they were accessed since their last reinsertion.
+ */
+type s3FIFOPolicy struct {
+	small, main, ghost *keyList
+	freq               map[string]int
+	// Maximum number of entries in the small queue and of keys in the
+	// ghost queue.
+	maxSmall, maxGhost int64
+	// Key returned by the last call to Victim.
+	victim string
+}
+
+// NewS3FIFOPolicy creates an S3-FIFO eviction policy, which quickly evicts
+// entries that are only accessed once.
+func NewS3FIFOPolicy(capacity int64) EvictionPolicy {
+	p := &s3FIFOPolicy{
+		small: newKeyList(),
+		main:  newKeyList(),
+		ghost: newKeyList(),
+		freq:  map[string]int{},
+	}
+	p.Resize(capacity)
+	return p
+}
+
+func (p *s3FIFOPolicy) Resize(capacity int64) {
+	// The small queue holds 10% of the entries.
+	p.maxSmall = capacity / 10
+	p.maxGhost = capacity - capacity/10
+	if p.maxSmall < 1 {
+		p.maxSmall = 1
+	}
+	if p.maxGhost < 1 {
+		p.maxGhost = 1
+	}
+}
+
+func (p *s3FIFOPolicy) ShouldAddEntry(key string, value interface{}) bool {
+	return true
+}
+
+func (p *s3FIFOPolicy) ShouldKeepEntry(key string, value interface{}) bool {
+	if freq, ok := p.freq[key]; ok && freq < s3FIFOMaxFreq {
+		p.freq[key] = freq + 1
+	}
+	return true
+}
+
+func (p *s3FIFOPolicy) EntryAdded(key string, value interface{}) {
+	p.freq[key] = 0
+	if p.ghost.remove(key) {
+		p.main.pushFront(key)
+	} else {
+		p.small.pushFront(key)
+	}
+	// The ghost queue is only trimmed once the key was looked up in it, as
+	// adding an entry to a full cache first evicts another one.
+	for p.ghost.len() > p.maxGhost {
+		p.ghost.popBack()
+	}
+}
+
+func (p *s3FIFOPolicy) EntryRemoved(key string) {
+	evicted := key == p.victim
+	p.victim = ""
+	delete(p.freq, key)
+	if p.small.remove(key) && evicted {
+		p.ghost.pushFront(key)
+		return
+	}
+	p.main.remove(key)
+}
+
+func (p *s3FIFOPolicy) Victim() (string, bool) {
+	var ok bool
+	if p.small.len() >= p.maxSmall || p.main.len() == 0 {
+		p.victim, ok = p.victimFromSmall()
+	}
+	if !ok {
+		p.victim, ok = p.victimFromMain()
+	}
+	return p.victim, ok
+}
+
+// victimFromSmall moves the entries of the small queue that were accessed
+// to the main queue, until it finds one that wasn't.
+func (p *s3FIFOPolicy) victimFromSmall() (string, bool) {
+	for {
+		key, ok := p.small.back()
+		if !ok {
+			return "", false
+		}
+		if p.freq[key] == 0 {
+			return key, true
+		}
+		p.small.remove(key)
+		p.freq[key] = 0
+		p.main.pushFront(key)
+	}
+}
+
+// victimFromMain reinserts the entries of the main queue that were accessed,
+// until it finds one that wasn't.
+func (p *s3FIFOPolicy) victimFromMain() (string, bool) {
+	for {
+		key, ok := p.main.back()
+		if !ok {
+			return "", false
+		}
+		if p.freq[key] == 0 {
+			return key, true
+		}
+		p.freq[key]--
+		p.main.remove(key)
+		p.main.pushFront(key)
+	}
+}
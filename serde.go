@@ -1,36 +1,96 @@
 package hypercache
 
-import "github.com/vmihailenco/msgpack/v5"
+import "fmt"
 
+// serde converts values to and from what is stored in redis. Both methods
+// are given the redis key of the value.
 type serde interface {
-	serialize(interface{}) ([]byte, error)
-	deserialize(buff []byte, value interface{}) error
+	serialize(key string, value interface{}) ([]byte, error)
+	deserialize(key string, buff []byte, value interface{}) error
 }
 
+// defaultSerde stores strings and byte slices as-is and delegates every
+// other type to its codec. Enveloped values are detected on read and decoded
+// with the codec recorded in their header, and decompressed if needed.
 type defaultSerde struct {
+	codec Codec
+	// Whether serialized values are prefixed with an envelope header.
+	envelope bool
+	// Algorithm used to compress values of at least compressionThreshold bytes.
+	compression          Compression
+	compressionThreshold int
+	// Algorithm used to checksum values.
+	checksum Checksum
+
+	stats *cacheStats
+}
+
+func newDefaultSerde(codec Codec, o *options, stats *cacheStats) *defaultSerde {
+	if codec == nil {
+		codec = MsgpackCodec{}
+	}
+	return &defaultSerde{
+		codec: codec,
+		// Compression and checksums are flagged in the envelope.
+		envelope:             o.envelope || o.compression != NoCompression || o.checksum != NoChecksum,
+		compression:          o.compression,
+		compressionThreshold: o.compressionThreshold,
+		checksum:             o.checksum,
+		stats:                stats,
+	}
 }
 
-func (cd defaultSerde) serialize(value interface{}) ([]byte, error) {
+func (cd defaultSerde) serialize(key string, value interface{}) ([]byte, error) {
+	var b []byte
 	switch value := value.(type) {
 	case nil:
 		return nil, nil
 	case []byte:
-		return value, nil
+		b = value
 	case string:
-		return []byte(value), nil
+		b = []byte(value)
+	default:
+		var err error
+		b, err = cd.codec.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	b, err := msgpack.Marshal(value)
-	if err != nil {
-		return nil, err
+	if !cd.envelope {
+		return b, nil
 	}
-	println(b)
 
-	// TODO: Maybe compress the value?
-	return b, nil
+	flags := cd.checksum.flags()
+	if cd.compression != NoCompression && len(b) >= cd.compressionThreshold {
+		compressed, err := cd.compression.compress(b)
+		if err != nil {
+			return nil, err
+		}
+		// Only keep the compressed value if it actually saves space.
+		if len(compressed) < len(b) {
+			cd.stats.recordCompression(len(b), len(compressed))
+			b = compressed
+			flags |= byte(cd.compression)
+		}
+	}
+
+	id, ok := codecID(cd.codec)
+	if !ok {
+		return nil, fmt.Errorf("cache: codec %T is not registered", cd.codec)
+	}
+	header := envelopeHeader{
+		version: envelopeVersion,
+		codecID: id,
+		flags:   flags,
+	}
+	buff := make([]byte, 0, envelopeHeaderSize+len(b)+cd.checksum.size())
+	buff = header.appendTo(buff)
+	buff = append(buff, b...)
+	return cd.checksum.appendTo(buff), nil
 }
 
-func (cd *defaultSerde) deserialize(buff []byte, value interface{}) error {
+func (cd *defaultSerde) deserialize(key string, buff []byte, value interface{}) error {
 	if buff == nil {
 		return nil
 	}
@@ -38,6 +98,25 @@ func (cd *defaultSerde) deserialize(buff []byte, value interface{}) error {
 		return nil
 	}
 
+	codec := cd.codec
+	if hasEnvelope(buff) {
+		header, payload, err := parseEnvelope(buff)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if codec, ok = codecByID(header.codecID); !ok {
+			return ErrUnknownCodec
+		}
+		compression := Compression(header.flags & envelopeCompressionMask)
+		if buff, err = compression.decompress(payload); err != nil {
+			return err
+		}
+		if len(buff) == 0 {
+			return nil
+		}
+	}
+
 	switch value := value.(type) {
 	case nil:
 		return nil
@@ -51,5 +130,5 @@ func (cd *defaultSerde) deserialize(buff []byte, value interface{}) error {
 		return nil
 	}
 
-	return msgpack.Unmarshal(buff, &value)
+	return codec.Unmarshal(buff, value)
 }
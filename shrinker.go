@@ -0,0 +1,73 @@
+package hypercache
+
+import "sync"
+
+// shrinker evicts entries from the shards of a cache after its capacity was
+// lowered, from a single goroutine started by the first request. Requests
+// made while a shrink is running are coalesced, so that shards are never
+// shrunk concurrently, and closing the shrinker waits for the goroutine.
+type shrinker struct {
+	mu       sync.Mutex
+	started  bool
+	closed   bool
+	requests chan struct{}
+	stop     chan struct{}
+	running  sync.WaitGroup
+	// Shrinks every overfull shard, returning early once stop is closed.
+	shrink func(stop <-chan struct{})
+}
+
+func newShrinker(shrink func(stop <-chan struct{})) *shrinker {
+	return &shrinker{
+		requests: make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		shrink:   shrink,
+	}
+}
+
+// request makes the goroutine shrink the shards. Once the shrinker is
+// closed, the shards are shrunk before returning instead.
+func (s *shrinker) request() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		s.shrink(nil)
+		return
+	}
+	if !s.started {
+		s.started = true
+		s.running.Add(1)
+		go s.run()
+	}
+	select {
+	case s.requests <- struct{}{}:
+	default:
+		// A shrink is already pending, and will see the new capacity.
+	}
+}
+
+func (s *shrinker) run() {
+	defer s.running.Done()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.requests:
+			s.shrink(s.stop)
+		}
+	}
+}
+
+// close stops the goroutine, interrupting the running shrink if any, and
+// waits for it to return.
+func (s *shrinker) close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.mu.Unlock()
+	close(s.stop)
+	s.running.Wait()
+}
@@ -0,0 +1,55 @@
+package hypercache
+
+import "time"
+
+const (
+	// Fraction of the window after which reads extend the TTL in redis
+	// when no refresh interval is set.
+	defaultSlidingRefreshRatio = 10
+)
+
+var (
+	// Extends the TTL of a key, unless it was overwritten since it was
+	// read.
+	slideScript = `
+		if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+			return 0
+		end
+		return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	`
+)
+
+// slidingRefresh returns how long after its last extension the TTL of a key
+// with the given window is extended again by reads.
+func (sc *synchronizedCache) slidingRefresh(window time.Duration) time.Duration {
+	refresh := sc.slidingRefreshInterval
+	if refresh == 0 {
+		refresh = window / defaultSlidingRefreshRatio
+	}
+	// Keys would expire between reads otherwise.
+	if refresh > window/2 {
+		refresh = window / 2
+	}
+	return refresh
+}
+
+// slide extends the TTL of a key read with the given remaining TTL to its
+// full window, in redis and in memory, if it was last extended at least the
+// refresh interval ago. It returns the remaining TTL of the key.
+func (sc *synchronizedCache) slide(key string, value []byte, window, remaining time.Duration) time.Duration {
+	if window-remaining < sc.slidingRefresh(window) {
+		return remaining
+	}
+	start := time.Now()
+	extended, err := sc.clients.Eval(sc.ctx, slideScript, []string{key}, value, ttlMilliseconds(window)).Int()
+	if err != nil || extended == 0 {
+		// Reads don't fail because the TTL couldn't be extended.
+		logDebug("Failed to extend TTL of %v: %v", key, err)
+		return remaining
+	}
+	sc.stats.slidingRefreshes.Add(1)
+	// The script checked that the value is still the one in redis.
+	expiresAt := start.Add(window)
+	sc.inMemCache.setExpiry(key, sc.localExpiry(expiresAt, start, 0), expiresAt)
+	return window
+}
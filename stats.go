@@ -0,0 +1,50 @@
+package hypercache
+
+import "sync/atomic"
+
+// Stats is a snapshot of the cache counters.
+type Stats struct {
+	// Number of values compressed before being written to redis.
+	CompressedValues int64
+	// Size of the compressed values before compression.
+	BytesBeforeCompression int64
+	// Size of the compressed values after compression.
+	BytesAfterCompression int64
+	// Ratio between the size of compressed values before and after
+	// compression, or 0 if no value was compressed.
+	CompressionRatio float64
+	// Number of values that failed their checksum and were deleted.
+	CorruptValues int64
+	// Number of times reads extended the TTL of sliding keys in redis.
+	SlidingRefreshes int64
+	// Maximum number of entries of the in-memory cache.
+	Capacity int64
+}
+
+type cacheStats struct {
+	compressedValues       atomic.Int64
+	bytesBeforeCompression atomic.Int64
+	bytesAfterCompression  atomic.Int64
+	corruptValues          atomic.Int64
+	slidingRefreshes       atomic.Int64
+}
+
+func (cs *cacheStats) recordCompression(before, after int) {
+	cs.compressedValues.Add(1)
+	cs.bytesBeforeCompression.Add(int64(before))
+	cs.bytesAfterCompression.Add(int64(after))
+}
+
+func (cs *cacheStats) snapshot() Stats {
+	s := Stats{
+		CompressedValues:       cs.compressedValues.Load(),
+		BytesBeforeCompression: cs.bytesBeforeCompression.Load(),
+		BytesAfterCompression:  cs.bytesAfterCompression.Load(),
+		CorruptValues:          cs.corruptValues.Load(),
+		SlidingRefreshes:       cs.slidingRefreshes.Load(),
+	}
+	if s.BytesAfterCompression > 0 {
+		s.CompressionRatio = float64(s.BytesBeforeCompression) / float64(s.BytesAfterCompression)
+	}
+	return s
+}
@@ -17,19 +17,43 @@ const (
 )
 
 var (
-	setAndPublishScript = `
+	// Writes the value and publishes it. If ARGV[5] holds a window, the
+	// value is written with a versioned header and a bumped version.
+	// Depending on ARGV[6], the key is only written if it doesn't exist yet
+	// (NX), if it already exists (XX) or if its version is ARGV[7]
+	// (VERSION), or its previous value is returned (GET).
+	setAndPublishScript = valueHeaderLua + `
+		local old = redis.call("GET", KEYS[1])
+		local version = headerVersion(old)
+		if (ARGV[6] == "NX" and old) or (ARGV[6] == "XX" and not old) then
+			return {0, version}
+		end
+		-- Version 0 stands for a missing key, not for a value without
+		-- version.
+		if ARGV[6] == "VERSION" and ((ARGV[7] == noVersion and old) or (ARGV[7] ~= noVersion and version ~= ARGV[7])) then
+			return {0, version}
+		end
+		local value = ARGV[1]
+		if ARGV[5] ~= "" then
+			version = nextVersion(version)
+			value = withHeader(ARGV[5], version, ARGV[1])
+		end
 		if ARGV[2] == "0" then
-			redis.call("SET", KEYS[1], ARGV[1])
+			redis.call("SET", KEYS[1], value)
 		else
-			redis.call("SET", KEYS[1], ARGV[1], "EX", ARGV[2])
+			redis.call("SET", KEYS[1], value, "PX", ARGV[2])
 		end
 		redis.call("PUBLISH", ARGV[3], ARGV[4])
+		if ARGV[6] == "GET" then
+			return {1, version, old}
+		end
+		return {1, version}
 	`
 
 	getCacheAndTTLRemainingScript = `
 		local result={}
     result[1] = redis.call('GET', KEYS[1])
-    result[2] = redis.call('TTL', KEYS[1])
+    result[2] = redis.call('PTTL', KEYS[1])
     return result;
 	`
 
@@ -38,9 +62,31 @@ var (
 		redis.call("PUBLISH", ARGV[1], ARGV[2])
 	`
 
+	deleteIfEqualAndPublishScript = `
+		if redis.call("GET", KEYS[1]) == ARGV[1] then
+			redis.call("DEL", KEYS[1])
+			redis.call("PUBLISH", ARGV[2], ARGV[3])
+		end
+	`
+
+	expireAndPublishScript = `
+		if redis.call("EXISTS", KEYS[1]) == 0 then
+			return 0
+		end
+		if ARGV[1] == "PERSIST" then
+			redis.call("PERSIST", KEYS[1])
+		else
+			redis.call(ARGV[1], KEYS[1], ARGV[2])
+		end
+		redis.call("PUBLISH", ARGV[3], ARGV[4])
+		return 1
+	`
+
 	DEBUG = false
 
-	ErrCacheMiss = errors.New("cache: key is missing")
+	ErrCacheMiss       = errors.New("cache: key is missing")
+	ErrVersionConflict = errors.New("cache: key was written since the expected version")
+	ErrNotVersioned    = errors.New("cache: versioning isn't enabled")
 )
 
 func logDebug(format string, a ...interface{}) {
@@ -56,6 +102,23 @@ type redisCacheEntry struct {
 	lastUpdatedTimestamp int64
 	// This is the key hash slot this entry belongs to.
 	keyHashSlot uint16
+	// This is the time the key expires in redis, in nanoseconds since the
+	// epoch, or 0 if it doesn't. The entry may expire from memory sooner.
+	expiresAt int64
+}
+
+// remainingTTL returns the time until the key of the entry expires in redis,
+// or 0 if it doesn't.
+func (e *redisCacheEntry) remainingTTL() time.Duration {
+	if e.expiresAt == 0 {
+		return 0
+	}
+	// Entries expire from memory no later than their key, so it's only
+	// reached on races.
+	if ttl := time.Until(unixNanoTime(e.expiresAt)); ttl > 0 {
+		return ttl
+	}
+	return time.Nanosecond
 }
 
 type cacheSyncMessage struct {
@@ -77,6 +140,31 @@ func (um *cacheSyncMessage) deserialize(buff []byte) {
 	um.keyHashSlot = binary.BigEndian.Uint16(buff[16:18])
 }
 
+// localCache is the in-memory cache in front of redis, holding
+// *redisCacheEntry values.
+type localCache interface {
+	Get(key string) (interface{}, bool)
+	Set(key string, value interface{}, ttl time.Duration) error
+	Delete(key string)
+	// getWithTTL returns the value of the key and the time until it
+	// expires, or 0 if it doesn't.
+	getWithTTL(key string) (interface{}, time.Duration, bool)
+	// setExpiry changes when the entry of the key expires, or makes it
+	// never expire if expiresAt is the zero time, and when its key expires
+	// in redis.
+	setExpiry(key string, expiresAt, keyExpiresAt time.Time) bool
+	// invalidate removes the entry of the key if it still holds the given
+	// value.
+	invalidate(key string, value interface{})
+	// inspect returns the metadata and value of the entry of the key,
+	// without counting it as an access.
+	inspect(key string) (EntryInfo, interface{}, bool)
+	Len() int64
+	Resize(maxEntries int64) error
+	Capacity() int64
+	Close()
+}
+
 type synchronizedCache struct {
 	clients redis.UniversalClient
 	// This is the last time each hash slot was updated.
@@ -84,40 +172,95 @@ type synchronizedCache struct {
 	// GUID of the cache.
 	uuid uuid.UUID
 	// In-memory cache.
-	inMemCache *memoryCache
+	inMemCache localCache
 	//No of the redis channel to listen for updates.
 	updateChannelName string
+	// Subscription to the update channel.
+	pubsub *redis.PubSub
 
 	mu sync.RWMutex
 
 	ctx context.Context
 
 	serde serde
+	// Serdes of key namespaces with their own codec.
+	namespaceSerdes []namespaceSerde
+	// Minimum time between TTL extensions of sliding keys by reads, or 0
+	// for a tenth of their window.
+	slidingRefreshInterval time.Duration
+	// Maximum time entries are kept in memory without being read again
+	// from redis, or 0 if they're kept as long as their key.
+	maxLocalTTL time.Duration
+	// Extends the TTLs of written keys.
+	jitter ttlJitter
+	// Whether values are written with a version.
+	versioning bool
+
+	stats *cacheStats
 }
 
-func NewSynchronizedCache(clients redis.UniversalClient, updateChannelName string, maxEntries int64) *synchronizedCache {
+func NewSynchronizedCache(clients redis.UniversalClient, updateChannelName string, maxEntries int64, opts ...Option) *synchronizedCache {
 	if clients == nil {
 		panic("clients cannot be nil")
 	}
+	o := newOptions(opts)
+	memOpts := opts
+	if o.onRemoval != nil {
+		// Listeners get the serialized value rather than the internal entry.
+		onRemoval := o.onRemoval
+		memOpts = append(opts[:len(opts):len(opts)], WithOnRemoval(func(key string, value interface{}, reason RemovalReason) {
+			_, payload, _ := readValueHeader(serializedValue(value), o.versioning)
+			onRemoval(key, payload, reason)
+		}))
+	}
+	stats := &cacheStats{}
+	var inMemCache localCache
+	if o.arenaSize > 0 {
+		inMemCache = newArenaCache(maxEntries, memOpts...)
+	} else {
+		inMemCache = newMemoryCache(maxEntries, memOpts...)
+	}
 	sc := &synchronizedCache{
-		clients:             clients,
-		hashSlotLastUpdated: make([]int64, 16384),
-		uuid:                uuid.New(),
-		inMemCache:          newMemoryCache(maxEntries),
-		updateChannelName:   updateChannelName,
-		ctx:                 context.Background(),
-		serde:               &defaultSerde{},
+		clients:                clients,
+		hashSlotLastUpdated:    make([]int64, 16384),
+		uuid:                   uuid.New(),
+		inMemCache:             inMemCache,
+		updateChannelName:      updateChannelName,
+		ctx:                    context.Background(),
+		slidingRefreshInterval: o.slidingRefreshInterval,
+		maxLocalTTL:            o.maxLocalTTL,
+		jitter:                 o.jitter,
+		versioning:             o.versioning,
+		stats:                  stats,
+	}
+	var err error
+	if sc.serde, err = o.newSerde(o.codec, stats); err == nil {
+		sc.namespaceSerdes, err = o.namespaceSerdes(stats)
+	}
+	if err != nil {
+		panic(err.Error())
 	}
-	// Start the update listener.
-	go sc.updateListener()
-	return sc
-}
-
-func (sc *synchronizedCache) updateListener() {
 	log.Printf("Starting update listener for cache %s", sc.uuid.String())
 	// Subscribe to the update channel.
 	pubsub := sc.clients.Subscribe(sc.ctx, sc.updateChannelName)
 	// Wait for confirmation that subscription is created before publishing anything.
+	if _, err := pubsub.Receive(sc.ctx); err != nil {
+		log.Printf("Failed to subscribe to %s: %v", sc.updateChannelName, err)
+	}
+	sc.pubsub = pubsub
+	// Start the update listener.
+	go sc.updateListener(pubsub)
+	return sc
+}
+
+// Close stops listening for updates and stops the janitor of the in-memory
+// cache. The redis clients are left open.
+func (sc *synchronizedCache) Close() error {
+	sc.inMemCache.Close()
+	return sc.pubsub.Close()
+}
+
+func (sc *synchronizedCache) updateListener(pubsub *redis.PubSub) {
 	ch := pubsub.Channel()
 	// Loop forever, listening for updates.
 	for msg := range ch {
@@ -141,8 +284,71 @@ func (sc *synchronizedCache) updateListener() {
 	}
 }
 
+// Stats returns a snapshot of the cache counters.
+func (sc *synchronizedCache) Stats() Stats {
+	s := sc.stats.snapshot()
+	s.Capacity = sc.inMemCache.Capacity()
+	return s
+}
+
+// Inspect returns the metadata of the in-memory entry of the key, or false if
+// it isn't cached in memory. Inspecting an entry doesn't count as an access.
+func (sc *synchronizedCache) Inspect(key string) (EntryInfo, bool) {
+	info, value, ok := sc.inMemCache.inspect(key)
+	if !ok {
+		return info, false
+	}
+	if entry, ok := value.(*redisCacheEntry); ok {
+		sc.mu.RLock()
+		info.Stale = sc.hashSlotLastUpdated[entry.keyHashSlot] >= entry.lastUpdatedTimestamp
+		sc.mu.RUnlock()
+	}
+	return info, true
+}
+
+// Resize changes the maximum number of entries of the in-memory cache. When
+// it shrinks, entries are evicted down to the new size in the background.
+func (sc *synchronizedCache) Resize(maxEntries int64) error {
+	return sc.inMemCache.Resize(maxEntries)
+}
+
+// serdeFor returns the serde used for the given key.
+func (sc *synchronizedCache) serdeFor(key string) serde {
+	if s, ok := findNamespaceSerde(sc.namespaceSerdes, key); ok {
+		return s
+	}
+	return sc.serde
+}
+
 func (sc *synchronizedCache) Get(key string, dest interface{}) error {
-	timestamp := time.Now().UnixMicro()
+	_, _, err := sc.get(key, dest)
+	return err
+}
+
+// GetWithTTL reads the value of the key into dest like Get, and returns the
+// time until the key expires, or 0 if it doesn't.
+func (sc *synchronizedCache) GetWithTTL(key string, dest interface{}) (time.Duration, error) {
+	ttl, _, err := sc.get(key, dest)
+	return ttl, err
+}
+
+// GetVersioned reads the value of the key into dest like Get, and returns its
+// version, which changes every time the key is written. Passing it to
+// CompareAndSet only writes the key if it wasn't written since. It returns
+// ErrNotVersioned unless the cache was created with WithVersioning.
+func (sc *synchronizedCache) GetVersioned(key string, dest interface{}) (uint64, error) {
+	if !sc.versioning {
+		return 0, ErrNotVersioned
+	}
+	_, header, err := sc.get(key, dest)
+	return header.version, err
+}
+
+// get reads the value of the key into dest, and returns the time until the
+// key expires and the header of its value.
+func (sc *synchronizedCache) get(key string, dest interface{}) (time.Duration, valueHeader, error) {
+	start := time.Now()
+	timestamp := start.UnixMicro()
 	// Get the cache entry from the in-memory cache.
 	entry, ok := sc.inMemCache.Get(key)
 	var cacheEntry *redisCacheEntry
@@ -157,77 +363,250 @@ func (sc *synchronizedCache) Get(key string, dest interface{}) error {
 		if hasExpired {
 			// copy struct to dest
 			// err := copyStruct(cacheEntry.value, dest)
-			err := sc.serde.deserialize(cacheEntry.value.([]byte), dest)
-			return err
+			serializedVal := cacheEntry.value.([]byte)
+			header, payload, err := readValueHeader(serializedVal, sc.versioning)
+			if err == nil {
+				err = sc.serdeFor(key).deserialize(key, payload, dest)
+			}
+			if errors.Is(err, ErrChecksumMismatch) {
+				return 0, header, sc.removeCorrupted(key, serializedVal)
+			}
+			if err != nil {
+				return 0, header, err
+			}
+			remaining := cacheEntry.remainingTTL()
+			if header.window > 0 && remaining > 0 {
+				remaining = sc.slide(key, serializedVal, header.window, remaining)
+			}
+			return remaining, header, nil
 		}
+		// Another instance updated the slot of the entry since it was
+		// cached.
+		sc.inMemCache.invalidate(key, cacheEntry)
 	}
 
 	// Either the entry doesn't exist, or it has expired.
 	// So get the entry from Redis.
 	result, err := sc.clients.Eval(sc.ctx, getCacheAndTTLRemainingScript, []string{key}).Result()
 	if err != redis.Nil && err != nil {
-		return err
+		return 0, valueHeader{}, err
 	}
 
 	val, ttl := result.([]interface{})[0], result.([]interface{})[1]
 	logDebug("Val %v -- TTL%v", result.([]interface{})[0], result.([]interface{})[1])
 	if val == nil {
 		// The entry doesn't exist in Redis, so it doesn't exist in the cache.
-		return ErrCacheMiss
+		return 0, valueHeader{}, ErrCacheMiss
 	}
 
 	if slot == -1 {
 		slot = int(crc16CCITT([]byte(key)) % HASH_SLOT_COUNT)
 	}
-	err = sc.serde.deserialize([]byte(val.(string)), dest)
+	serializedVal := []byte(val.(string))
+	header, payload, err := readValueHeader(serializedVal, sc.versioning)
+	if err == nil {
+		err = sc.serdeFor(key).deserialize(key, payload, dest)
+	}
+	if errors.Is(err, ErrChecksumMismatch) {
+		return 0, header, sc.removeCorrupted(key, serializedVal)
+	}
 	if err != nil {
-		return err
+		return 0, header, err
+	}
+	// PTTL returns -1 for keys that don't expire. The TTL is counted from
+	// before the script ran, so that the entry doesn't outlive the key.
+	var remaining time.Duration
+	var expiresAt time.Time
+	if milliseconds := ttl.(int64); milliseconds > 0 {
+		remaining = time.Duration(milliseconds) * time.Millisecond
+		if header.window > 0 {
+			remaining = sc.slide(key, serializedVal, header.window, remaining)
+		}
+		expiresAt = start.Add(remaining)
 	}
 
 	// Create a new cache entry.
-	entry = &redisCacheEntry{
-		value:                dest,
+	cacheEntry = &redisCacheEntry{
+		value:                serializedVal,
 		lastUpdatedTimestamp: timestamp,
 		keyHashSlot:          uint16(slot),
+		expiresAt:            unixNano(expiresAt),
 	}
 	// Set the entry in the in-memory cache.
-	if err := sc.inMemCache.Set(key, entry, time.Duration(ttl.(int64))*time.Second); err != nil {
-		return err
+	if err := sc.setLocal(key, cacheEntry, expiresAt, 0); err != nil {
+		return 0, header, err
 	}
 
-	return nil
+	return remaining, header, nil
+}
+
+// Set writes the value of the key to redis and memory, and tells other
+// instances. A TTL of 0 makes the key never expire.
+func (sc *synchronizedCache) Set(key string, value interface{}, ttl time.Duration, opts ...SetOption) error {
+	_, _, _, err := sc.set(key, value, ttl, "", 0, opts)
+	return err
+}
+
+// SetIfAbsent writes the value of the key like Set, only if the key doesn't
+// exist yet. It reports whether it was written.
+func (sc *synchronizedCache) SetIfAbsent(key string, value interface{}, ttl time.Duration, opts ...SetOption) (bool, error) {
+	written, _, _, err := sc.set(key, value, ttl, "NX", 0, opts)
+	return written, err
+}
+
+// SetIfPresent writes the value of the key like Set, only if the key already
+// exists. It reports whether it was written.
+func (sc *synchronizedCache) SetIfPresent(key string, value interface{}, ttl time.Duration, opts ...SetOption) (bool, error) {
+	written, _, _, err := sc.set(key, value, ttl, "XX", 0, opts)
+	return written, err
 }
 
-func (sc *synchronizedCache) Set(key string, value interface{}, ttl time.Duration) error {
+// GetAndSet writes the value of the key like Set, and reads its previous
+// value into dest. It reports whether the key existed.
+func (sc *synchronizedCache) GetAndSet(key string, value interface{}, ttl time.Duration, dest interface{}, opts ...SetOption) (bool, error) {
+	_, _, old, err := sc.set(key, value, ttl, "GET", 0, opts)
+	if err != nil || old == nil {
+		return false, err
+	}
+	_, payload, err := readValueHeader(old, sc.versioning)
+	if err != nil {
+		return true, err
+	}
+	return true, sc.serdeFor(key).deserialize(key, payload, dest)
+}
+
+// CompareAndSet writes the value of the key like Set, only if its version is
+// still the expected one, as returned by GetVersioned, or 0 if the key must
+// not exist. It returns the new version of the key, or ErrVersionConflict if
+// it was written since. Keys holding a value written without versioning
+// conflict with every version. It returns ErrNotVersioned unless the cache
+// was created with WithVersioning.
+func (sc *synchronizedCache) CompareAndSet(key string, expectedVersion uint64, value interface{}, ttl time.Duration, opts ...SetOption) (uint64, error) {
+	if !sc.versioning {
+		return 0, ErrNotVersioned
+	}
+	written, version, _, err := sc.set(key, value, ttl, "VERSION", expectedVersion, opts)
+	if err != nil {
+		return 0, err
+	}
+	if !written {
+		// The version may have been read from a stale entry if an update
+		// notification was lost, so the key is read again from redis.
+		if _, value, ok := sc.inMemCache.inspect(key); ok {
+			sc.inMemCache.invalidate(key, value)
+		}
+		return 0, ErrVersionConflict
+	}
+	return version, nil
+}
+
+// set writes the value of the key under the given condition of
+// setAndPublishScript, or unconditionally if it's empty. It returns whether
+// the value was written, the version of the key, and its previous value for
+// the GET condition.
+func (sc *synchronizedCache) set(key string, value interface{}, ttl time.Duration, condition string, expectedVersion uint64, opts []SetOption) (bool, uint64, []byte, error) {
+	o := newSetOptions(opts)
+	// Reads extend sliding keys by the TTL they were written with, the
+	// jitter only spreads their first expiry.
+	var window time.Duration
+	if o.sliding && ttl > 0 {
+		window = ttl
+	}
+	ttl = sc.jitter.apply(key, ttl)
 	// Create a new cache entry.
 	slot := crc16CCITT([]byte(key)) % HASH_SLOT_COUNT
-	timestamp := time.Now().UnixMicro()
-	ttlSeconds := int64(ttl / time.Second)
+	start := time.Now()
+	timestamp := start.UnixMicro()
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = start.Add(ttl)
+	}
 	// serialize value to byte array
-	serializedVal, err := sc.serde.serialize(value)
+	serializedVal, err := sc.serdeFor(key).serialize(key, value)
 	if err != nil {
-		return err
+		return false, 0, nil, err
+	}
+	// Versioned headers are built by the script, which bumps the version.
+	var windowArg []byte
+	if sc.versioning {
+		windowArg = uint64Bytes(uint64(ttlMilliseconds(window)))
+	} else if window > 0 {
+		serializedVal = withSlidingHeader(window, serializedVal)
 	}
 	logDebug("Setting %v", value)
 
+	// Set and publish the entry.
+	result, err := sc.clients.Eval(sc.ctx, setAndPublishScript, []string{key}, serializedVal, ttlMilliseconds(ttl), sc.updateChannelName, cacheSyncMessage{
+		keyHashSlot: slot,
+		uuid:        sc.uuid,
+	}.serialize(), windowArg, condition, uint64Bytes(expectedVersion)).Slice()
+	if err != nil {
+		return false, 0, nil, err
+	}
+	version := binary.BigEndian.Uint64([]byte(result[1].(string)))
+	if result[0].(int64) == 0 {
+		return false, version, nil, nil
+	}
+	var old []byte
+	if len(result) > 2 && result[2] != nil {
+		old = []byte(result[2].(string))
+	}
+
+	if sc.versioning {
+		// The script built the same header around the value.
+		serializedVal = withVersionedHeader(valueHeader{window: window, version: version}, serializedVal)
+	}
 	entry := &redisCacheEntry{
 		value:                serializedVal,
 		lastUpdatedTimestamp: timestamp,
 		keyHashSlot:          slot,
+		expiresAt:            unixNano(expiresAt),
 	}
+	return true, version, old, sc.setLocal(key, entry, expiresAt, o.localTTL)
+}
 
-	// Set and publish the entry.
-	_, err = sc.clients.Eval(sc.ctx, setAndPublishScript, []string{key}, serializedVal, ttlSeconds, sc.updateChannelName, cacheSyncMessage{
-		keyHashSlot: slot,
-		uuid:        sc.uuid,
-	}.serialize()).Result()
+// ttlMilliseconds returns the TTL in milliseconds, rounded up so that short
+// TTLs don't make keys never expire, or 0 if there is none.
+func ttlMilliseconds(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return int64((ttl + time.Millisecond - 1) / time.Millisecond)
+}
 
-	if err != redis.Nil && err != nil {
-		return err
+// setLocal stores the entry in memory until the given time, or without
+// expiry if it's the zero time, and no longer than the given maximum TTL, or
+// the one of the cache if it's 0.
+func (sc *synchronizedCache) setLocal(key string, entry *redisCacheEntry, expiresAt time.Time, maxTTL time.Duration) error {
+	expiresAt = sc.localExpiry(expiresAt, time.Now(), maxTTL)
+	var ttl time.Duration
+	if !expiresAt.IsZero() {
+		ttl = time.Until(expiresAt)
+		if ttl <= 0 {
+			// The key already expired, and a TTL of 0 would keep
+			// the entry forever.
+			sc.inMemCache.Delete(key)
+			return nil
+		}
 	}
+	return sc.inMemCache.Set(key, entry, ttl)
+}
 
-	sc.inMemCache.Set(key, entry, ttl)
-	return nil
+// localExpiry returns when an entry expiring from redis at the given time
+// expires from memory, if it was read from redis at the given time. The
+// maximum TTL defaults to the one of the cache if it's 0.
+func (sc *synchronizedCache) localExpiry(expiresAt, readAt time.Time, maxTTL time.Duration) time.Time {
+	if maxTTL == 0 {
+		maxTTL = sc.maxLocalTTL
+	}
+	if maxTTL == 0 {
+		return expiresAt
+	}
+	limit := readAt.Add(maxTTL)
+	if expiresAt.IsZero() || expiresAt.After(limit) {
+		return limit
+	}
+	return expiresAt
 }
 
 func (sc *synchronizedCache) Delete(key string) {
@@ -239,3 +618,72 @@ func (sc *synchronizedCache) Delete(key string) {
 	// Delete the entry from the in-memory cache.
 	sc.inMemCache.Delete(key)
 }
+
+// Touch changes the TTL of the key in redis and in memory without rewriting
+// its value, and tells other instances. A TTL of 0 makes the key never
+// expire. It returns ErrCacheMiss if the key doesn't exist.
+func (sc *synchronizedCache) Touch(key string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return sc.expire(key, "PERSIST", 0, time.Time{})
+	}
+	return sc.expire(key, "PEXPIRE", ttlMilliseconds(ttl), time.Now().Add(ttl))
+}
+
+// ExpireAt makes the key expire at the given time in redis and in memory
+// without rewriting its value, and tells other instances. A time that isn't
+// in the future, including the zero time, deletes the key. It returns
+// ErrCacheMiss if the key doesn't exist.
+func (sc *synchronizedCache) ExpireAt(key string, at time.Time) error {
+	if !at.After(time.Now()) {
+		// Redis deletes keys expiring in the past, while a zero expiry
+		// means never in memory.
+		at = time.UnixMilli(0)
+	}
+	return sc.expire(key, "PEXPIREAT", at.UnixMilli(), at)
+}
+
+// expire runs the given redis command to change the expiry of the key, and
+// updates it in memory.
+func (sc *synchronizedCache) expire(key string, command string, arg int64, expiresAt time.Time) error {
+	updated, err := sc.clients.Eval(sc.ctx, expireAndPublishScript, []string{key}, command, arg, sc.updateChannelName, cacheSyncMessage{
+		keyHashSlot: crc16CCITT([]byte(key)) % HASH_SLOT_COUNT,
+		uuid:        sc.uuid,
+	}.serialize()).Int()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		sc.inMemCache.Delete(key)
+		return ErrCacheMiss
+	}
+	if !expiresAt.IsZero() && !expiresAt.After(time.Now()) {
+		sc.inMemCache.Delete(key)
+		return nil
+	}
+	// The value isn't read again, so the entry is kept in memory no longer
+	// than it would have been otherwise.
+	_, value, ok := sc.inMemCache.inspect(key)
+	if !ok {
+		return nil
+	}
+	readAt := time.UnixMicro(value.(*redisCacheEntry).lastUpdatedTimestamp)
+	sc.inMemCache.setExpiry(key, sc.localExpiry(expiresAt, readAt, 0), expiresAt)
+	return nil
+}
+
+// removeCorrupted deletes an entry whose value failed its checksum, and
+// reports it as a miss. The entry is only deleted from redis if it still
+// holds the corrupted value.
+func (sc *synchronizedCache) removeCorrupted(key string, value []byte) error {
+	logDebug("Removing corrupted entry %v", key)
+	sc.stats.corruptValues.Add(1)
+	sc.inMemCache.Delete(key)
+	err := sc.clients.Eval(sc.ctx, deleteIfEqualAndPublishScript, []string{key}, value, sc.updateChannelName, cacheSyncMessage{
+		keyHashSlot: crc16CCITT([]byte(key)) % HASH_SLOT_COUNT,
+		uuid:        sc.uuid,
+	}.serialize()).Err()
+	if err != redis.Nil && err != nil {
+		return err
+	}
+	return ErrCacheMiss
+}
@@ -1,7 +1,10 @@
 package hypercache
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -56,11 +59,11 @@ func TestCreateSyncCache(t *testing.T) {
 		t.Errorf("Failed to create sync cache")
 	}
 
-	if cache.inMemCache.maxEntries.Load() != 10 {
+	if cache.inMemCache.Capacity() != 10 {
 		t.Errorf("Failed to create maxEntries")
 	}
 
-	if cache.inMemCache.numEntries.Load() != 0 {
+	if cache.inMemCache.Len() != 0 {
 		t.Errorf("Failed to create numEntries")
 	}
 
@@ -82,6 +85,39 @@ func TestCreateSyncCache(t *testing.T) {
 	}
 }
 
+func TestSyncCacheClose(t *testing.T) {
+	cache := NewSynchronizedCache(createRedisClient(), chanName, 10, WithJanitor(10*time.Millisecond, 0))
+	if err := cache.Close(); err != nil {
+		t.Errorf("Failed to close cache: %v", err)
+	}
+
+	select {
+	case <-cache.inMemCache.(*memoryCache).stop:
+	default:
+		t.Errorf("Janitor should have stopped")
+	}
+
+	// The redis client is still usable.
+	if cache.clients.Ping(cache.ctx).Err() != nil {
+		t.Errorf("Should not close the redis client")
+	}
+}
+
+func TestSyncCacheResize(t *testing.T) {
+	cache := NewSynchronizedCache(createRedisClient(), chanName, 10)
+	defer cache.Close()
+
+	if cache.Stats().Capacity != 10 {
+		t.Errorf("Capacity should be 10, got %d", cache.Stats().Capacity)
+	}
+	if err := cache.Resize(20); err != nil {
+		t.Errorf("Failed to resize: %v", err)
+	}
+	if cache.Stats().Capacity != 20 {
+		t.Errorf("Capacity should be 20, got %d", cache.Stats().Capacity)
+	}
+}
+
 func TestSyncCacheAdd(t *testing.T) {
 	cache := NewSynchronizedCache(createRedisClient(), chanName, 10)
 	if cache == nil {
@@ -92,7 +128,7 @@ func TestSyncCacheAdd(t *testing.T) {
 	if err != nil {
 		t.Errorf("Failed to add entry")
 	}
-	if cache.inMemCache.numEntries.Load() != 1 {
+	if cache.inMemCache.Len() != 1 {
 		t.Errorf("Failed to add entry")
 	}
 	if _, ok := cache.inMemCache.Get("k1"); !ok {
@@ -207,6 +243,662 @@ func TestSyncCacheWithTwoClients_SecondHasFirstValue(t *testing.T) {
 	cleanup(cache2.clients)
 }
 
+func TestSyncCacheOnRemovalInvalidated(t *testing.T) {
+	removed := make(chan []byte, 1)
+	cache1 := NewSynchronizedCache(createRedisClient(), chanName, 10, WithOnRemoval(func(key string, value interface{}, reason RemovalReason) {
+		if key == "k1" && reason == RemovalInvalidated {
+			removed <- value.([]byte)
+		}
+	}))
+	cache2 := NewSynchronizedCache(createRedisClient(), chanName, 10)
+	defer cache1.Close()
+	defer cache2.Close()
+
+	if err := cache1.Set("k1", "v1", 0); err != nil {
+		t.Errorf("Failed to add entry")
+	}
+	if err := cache2.Set("k1", "v2", 0); err != nil {
+		t.Errorf("Failed to add entry")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	val := ""
+	if err := cache1.Get("k1", &val); err != nil || val != "v2" {
+		t.Errorf("Failed to get entry")
+	}
+
+	select {
+	case value := <-removed:
+		if string(value) != "v1" {
+			t.Errorf("Should report the serialized stale value, got %q", value)
+		}
+	default:
+		t.Errorf("Should have reported the stale entry as invalidated")
+	}
+	cleanup(cache1.clients)
+}
+
+func TestSyncCacheWithArenaStorage(t *testing.T) {
+	cache1 := NewSynchronizedCache(createRedisClient(), chanName, 10, WithArenaStorage(1<<16))
+	cache2 := NewSynchronizedCache(createRedisClient(), chanName, 10, WithArenaStorage(1<<16))
+	defer cache1.Close()
+	defer cache2.Close()
+
+	if err := cache1.Set("k1", testStruct{Name: "v1", Age: 1}, 0); err != nil {
+		t.Errorf("Failed to add entry")
+	}
+	val := testStruct{}
+	if err := cache1.Get("k1", &val); err != nil || val.Name != "v1" {
+		t.Errorf("Failed to get entry")
+	}
+
+	if err := cache2.Set("k1", testStruct{Name: "v2", Age: 2}, 0); err != nil {
+		t.Errorf("Failed to add entry")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if err := cache1.Get("k1", &val); err != nil || val.Name != "v2" {
+		t.Errorf("Should have fetched the value updated by another instance, got %v", val)
+	}
+	cleanup(cache1.clients)
+}
+
+func TestSyncCacheInspect(t *testing.T) {
+	cache1 := NewSynchronizedCache(createRedisClient(), chanName, 10)
+	cache2 := NewSynchronizedCache(createRedisClient(), chanName, 10)
+	defer cache1.Close()
+	defer cache2.Close()
+
+	if err := cache1.Set("k1", "v1", time.Minute); err != nil {
+		t.Errorf("Failed to add entry")
+	}
+	info, ok := cache1.Inspect("k1")
+	if !ok {
+		t.Fatalf("Failed to inspect entry")
+	}
+	if info.Stale || info.Slot != crc16CCITT([]byte("k1"))%HASH_SLOT_COUNT || info.TTL <= 0 {
+		t.Errorf("Should report fresh entry with its slot and TTL, got %+v", info)
+	}
+
+	if err := cache2.Set("k1", "v2", time.Minute); err != nil {
+		t.Errorf("Failed to add entry")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if info, ok := cache1.Inspect("k1"); !ok || !info.Stale {
+		t.Errorf("Should report entry updated by another instance as stale")
+	}
+	if _, ok := cache1.Inspect("missing"); ok {
+		t.Errorf("Should not inspect missing key")
+	}
+	cleanup(cache1.clients)
+}
+
+func TestSyncCacheGetWithTTL(t *testing.T) {
+	cache1 := NewSynchronizedCache(createRedisClient(), chanName, 10)
+	cache2 := NewSynchronizedCache(createRedisClient(), chanName, 10)
+	defer cache1.Close()
+	defer cache2.Close()
+
+	cache1.Set("k1", "v1", time.Minute)
+	cache1.Set("k2", "v2", 0)
+
+	val := ""
+	// Read from memory by the first instance, and from redis by the second.
+	for _, cache := range []*synchronizedCache{cache1, cache2} {
+		ttl, err := cache.GetWithTTL("k1", &val)
+		if err != nil || val != "v1" || ttl <= 58*time.Second || ttl > time.Minute {
+			t.Errorf("Should return value with TTL, got %v and %v", val, ttl)
+		}
+		if ttl, err := cache.GetWithTTL("k2", &val); err != nil || ttl != 0 {
+			t.Errorf("Should return no TTL for keys that don't expire, got %v", ttl)
+		}
+	}
+	if _, err := cache1.GetWithTTL("missing", &val); err != ErrCacheMiss {
+		t.Errorf("Should return cache miss, got %v", err)
+	}
+	cleanup(cache1.clients)
+}
+
+func TestSyncCacheTouch(t *testing.T) {
+	cache1 := NewSynchronizedCache(createRedisClient(), chanName, 10)
+	cache2 := NewSynchronizedCache(createRedisClient(), chanName, 10)
+	defer cache1.Close()
+	defer cache2.Close()
+
+	cache1.Set("k1", "v1", time.Minute)
+	val := ""
+	cache2.Get("k1", &val)
+
+	if err := cache1.Touch("k1", time.Hour); err != nil {
+		t.Fatalf("Failed to touch key: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if ttl := cache1.clients.TTL(cache1.ctx, "k1").Val(); ttl <= 59*time.Minute {
+		t.Errorf("Should change TTL in redis, got %v", ttl)
+	}
+	// Checked in memory by the first instance, and the second reads it
+	// again from redis as it was told the key changed.
+	for _, cache := range []*synchronizedCache{cache1, cache2} {
+		ttl, err := cache.GetWithTTL("k1", &val)
+		if err != nil || val != "v1" || ttl <= 59*time.Minute {
+			t.Errorf("Should return the new TTL, got %v", ttl)
+		}
+	}
+
+	if err := cache1.Touch("k1", 0); err != nil {
+		t.Fatalf("Failed to touch key: %v", err)
+	}
+	if ttl, _ := cache1.GetWithTTL("k1", &val); ttl != 0 {
+		t.Errorf("Should make the key never expire, got %v", ttl)
+	}
+	if err := cache1.Touch("missing", time.Minute); err != ErrCacheMiss {
+		t.Errorf("Should return cache miss, got %v", err)
+	}
+	cleanup(cache1.clients)
+}
+
+func TestSyncCacheExpireAt(t *testing.T) {
+	cache := NewSynchronizedCache(createRedisClient(), chanName, 10)
+	defer cache.Close()
+
+	cache.Set("k1", "v1", 0)
+	at := time.Now().Add(time.Hour)
+	if err := cache.ExpireAt("k1", at); err != nil {
+		t.Fatalf("Failed to set expiry: %v", err)
+	}
+	if ttl := cache.clients.TTL(cache.ctx, "k1").Val(); ttl <= 59*time.Minute {
+		t.Errorf("Should change TTL in redis, got %v", ttl)
+	}
+	val := ""
+	if ttl, _ := cache.GetWithTTL("k1", &val); ttl <= 59*time.Minute {
+		t.Errorf("Should change TTL in memory, got %v", ttl)
+	}
+
+	if err := cache.ExpireAt("k1", time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("Failed to set expiry: %v", err)
+	}
+	if err := cache.Get("k1", &val); err != ErrCacheMiss {
+		t.Errorf("Should expire the key, got %v", err)
+	}
+
+	// The zero time deletes the key rather than making it never expire.
+	cache.Set("k1", "v1", 0)
+	cache.Get("k1", &val)
+	if err := cache.ExpireAt("k1", time.Time{}); err != nil {
+		t.Fatalf("Failed to set expiry: %v", err)
+	}
+	if n := cache.clients.Exists(cache.ctx, "k1").Val(); n != 0 {
+		t.Errorf("Should delete the key in redis")
+	}
+	if err := cache.Get("k1", &val); err != ErrCacheMiss {
+		t.Errorf("Should delete the key in memory, got %v", err)
+	}
+	cleanup(cache.clients)
+}
+
+func TestSyncCacheMillisecondTTL(t *testing.T) {
+	cache1 := NewSynchronizedCache(createRedisClient(), chanName, 10)
+	cache2 := NewSynchronizedCache(createRedisClient(), chanName, 10)
+	defer cache1.Close()
+	defer cache2.Close()
+
+	if err := cache1.Set("k1", "v1", 300*time.Millisecond); err != nil {
+		t.Fatalf("Failed to add entry")
+	}
+	if ttl := cache1.clients.PTTL(cache1.ctx, "k1").Val(); ttl <= 0 || ttl > 300*time.Millisecond {
+		t.Errorf("Should expire in redis within 300ms, got %v", ttl)
+	}
+
+	val := ""
+	// The second instance reads the entry and its TTL from redis.
+	ttl, err := cache2.GetWithTTL("k1", &val)
+	if err != nil || ttl <= 0 || ttl > 300*time.Millisecond {
+		t.Errorf("Should return millisecond TTL, got %v", ttl)
+	}
+	if info, _ := cache2.Inspect("k1"); info.TTL > ttl {
+		t.Errorf("Should not keep the entry in memory longer than in redis, got %v", info.TTL)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	for _, cache := range []*synchronizedCache{cache1, cache2} {
+		if err := cache.Get("k1", &val); err != ErrCacheMiss {
+			t.Errorf("Should have expired, got %v", err)
+		}
+	}
+
+	cache1.Set("k2", "v2", time.Minute)
+	if err := cache1.Touch("k2", 1500*time.Millisecond); err != nil {
+		t.Fatalf("Failed to touch key: %v", err)
+	}
+	if ttl := cache1.clients.PTTL(cache1.ctx, "k2").Val(); ttl <= time.Second || ttl > 1500*time.Millisecond {
+		t.Errorf("Should change TTL in redis to 1.5s, got %v", ttl)
+	}
+	cleanup(cache1.clients)
+}
+
+func TestTTLMilliseconds(t *testing.T) {
+	cases := map[time.Duration]int64{
+		0:                       0,
+		-time.Second:            0,
+		time.Microsecond:        1,
+		500 * time.Millisecond:  500,
+		1500 * time.Microsecond: 2,
+	}
+	for ttl, want := range cases {
+		if got := ttlMilliseconds(ttl); got != want {
+			t.Errorf("%v: expected %dms, got %dms", ttl, want, got)
+		}
+	}
+}
+
+func TestSyncCacheSlidingExpiration(t *testing.T) {
+	cache1 := NewSynchronizedCache(createRedisClient(), chanName, 10, WithSlidingRefresh(50*time.Millisecond))
+	cache2 := NewSynchronizedCache(createRedisClient(), chanName, 10, WithSlidingRefresh(50*time.Millisecond))
+	defer cache1.Close()
+	defer cache2.Close()
+
+	if err := cache1.Set("k1", "v1", 300*time.Millisecond, WithSlidingExpiration()); err != nil {
+		t.Fatalf("Failed to add entry")
+	}
+	cache1.Set("k2", "v2", 300*time.Millisecond)
+
+	// Both instances keep reading the key well past its TTL.
+	val := ""
+	for i := 0; i < 6; i++ {
+		time.Sleep(100 * time.Millisecond)
+		for _, cache := range []*synchronizedCache{cache1, cache2} {
+			if err := cache.Get("k1", &val); err != nil || val != "v1" {
+				t.Fatalf("Should keep the key while it's read, got %v", err)
+			}
+		}
+		if ttl := cache1.clients.PTTL(cache1.ctx, "k1").Val(); ttl <= 200*time.Millisecond {
+			t.Errorf("Should extend TTL in redis, got %v", ttl)
+		}
+	}
+	if err := cache2.Get("k2", &val); err != ErrCacheMiss {
+		t.Errorf("Should not extend TTL of other keys, got %v", err)
+	}
+	// Reads within the refresh interval don't extend the TTL in redis.
+	refreshes := cache1.Stats().SlidingRefreshes
+	for i := 0; i < 20; i++ {
+		cache1.Get("k1", &val)
+	}
+	if refreshes == 0 || cache1.Stats().SlidingRefreshes > refreshes+1 {
+		t.Errorf("Should extend TTL once per refresh interval, got %d refreshes", cache1.Stats().SlidingRefreshes-refreshes)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	for _, cache := range []*synchronizedCache{cache1, cache2} {
+		if err := cache.Get("k1", &val); err != ErrCacheMiss {
+			t.Errorf("Should expire once no longer read, got %v", err)
+		}
+	}
+	cleanup(cache1.clients)
+}
+
+func TestSyncCacheMaxLocalTTL(t *testing.T) {
+	cache1 := NewSynchronizedCache(createRedisClient(), chanName, 10, WithMaxLocalTTL(100*time.Millisecond))
+	cache2 := NewSynchronizedCache(createRedisClient(), chanName, 10)
+	defer cache1.Close()
+	defer cache2.Close()
+
+	cache1.Set("k1", "v1", time.Hour)
+	if info, _ := cache1.Inspect("k1"); info.TTL <= 0 || info.TTL > 100*time.Millisecond {
+		t.Errorf("Should keep the entry in memory up to 100ms, got %v", info.TTL)
+	}
+	val := ""
+	if ttl, _ := cache1.GetWithTTL("k1", &val); ttl <= 59*time.Minute {
+		t.Errorf("Should return the TTL of the key in redis, got %v", ttl)
+	}
+
+	// The update notification is lost.
+	cache1.clients.Set(cache1.ctx, "k1", "v2", time.Hour)
+	if cache1.Get("k1", &val); val != "v1" {
+		t.Errorf("Should serve the stale value from memory, got %v", val)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if cache1.Get("k1", &val); val != "v2" {
+		t.Errorf("Should read the value again from redis, got %v", val)
+	}
+
+	// Touching the key doesn't keep the entry in memory longer.
+	cache1.Touch("k1", 2*time.Hour)
+	if info, _ := cache1.Inspect("k1"); info.TTL <= 0 || info.TTL > 100*time.Millisecond {
+		t.Errorf("Should keep the entry in memory up to 100ms, got %v", info.TTL)
+	}
+	if ttl, _ := cache1.GetWithTTL("k1", &val); ttl <= 119*time.Minute {
+		t.Errorf("Should return the new TTL of the key, got %v", ttl)
+	}
+
+	// The TTL can be set per write.
+	cache1.Set("k2", "v2", time.Hour, WithLocalTTL(time.Minute))
+	cache2.Set("k3", "v3", time.Hour, WithLocalTTL(50*time.Millisecond))
+	if info, _ := cache1.Inspect("k2"); info.TTL <= 59*time.Second || info.TTL > time.Minute {
+		t.Errorf("Should keep the entry in memory up to a minute, got %v", info.TTL)
+	}
+	if info, _ := cache2.Inspect("k3"); info.TTL <= 0 || info.TTL > 50*time.Millisecond {
+		t.Errorf("Should keep the entry in memory up to 50ms, got %v", info.TTL)
+	}
+	cleanup(cache1.clients)
+}
+
+func TestSyncCacheSlidingExpirationWithMaxLocalTTL(t *testing.T) {
+	cache := NewSynchronizedCache(createRedisClient(), chanName, 10, WithMaxLocalTTL(50*time.Millisecond))
+	defer cache.Close()
+
+	cache.Set("k1", "v1", 300*time.Millisecond, WithSlidingExpiration())
+	val := ""
+	for i := 0; i < 6; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if err := cache.Get("k1", &val); err != nil {
+			t.Fatalf("Should keep the key while it's read, got %v", err)
+		}
+		if info, _ := cache.Inspect("k1"); info.TTL > 50*time.Millisecond {
+			t.Errorf("Should keep the entry in memory up to 50ms, got %v", info.TTL)
+		}
+	}
+	// Reads from memory don't extend the TTL in redis every time.
+	refreshes := cache.Stats().SlidingRefreshes
+	for i := 0; i < 20; i++ {
+		cache.Get("k1", &val)
+	}
+	if cache.Stats().SlidingRefreshes > refreshes+1 {
+		t.Errorf("Should extend TTL once per refresh interval, got %d refreshes", cache.Stats().SlidingRefreshes-refreshes)
+	}
+	cleanup(cache.clients)
+}
+
+func TestSyncCacheTTLJitter(t *testing.T) {
+	cache1 := NewSynchronizedCache(createRedisClient(), chanName, 10, WithTTLJitter(0.5), WithDeterministicJitter())
+	cache2 := NewSynchronizedCache(createRedisClient(), chanName, 10, WithTTLJitter(0.5), WithDeterministicJitter())
+	defer cache1.Close()
+	defer cache2.Close()
+
+	ttls := map[time.Duration]bool{}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("jitter-%d", i)
+		defer cache1.Delete(key)
+		cache1.Set(key, "v", time.Minute)
+		ttl := cache1.clients.PTTL(cache1.ctx, key).Val()
+		if ttl <= 59*time.Second || ttl > 90*time.Second {
+			t.Errorf("Should extend TTL by up to 30s, got %v", ttl)
+		}
+		ttls[ttl/time.Second] = true
+
+		// Other instances give the key the same TTL.
+		cache2.Set(key, "v", time.Minute)
+		if other := cache2.clients.PTTL(cache2.ctx, key).Val(); other < ttl-100*time.Millisecond || other > ttl+100*time.Millisecond {
+			t.Errorf("Should give the key the same TTL, got %v and %v", ttl, other)
+		}
+	}
+	if len(ttls) < 5 {
+		t.Errorf("Should spread TTLs, got %d distinct ones", len(ttls))
+	}
+	cleanup(cache1.clients)
+}
+
+func TestSyncCacheTTLJitterWithSlidingExpiration(t *testing.T) {
+	cache := NewSynchronizedCache(createRedisClient(), chanName, 10, WithTTLJitter(0.5), WithDeterministicJitter())
+	defer cache.Close()
+	defer cache.Delete("jitter-sliding")
+
+	cache.Set("jitter-sliding", "v", time.Minute, WithSlidingExpiration())
+	if ttl := cache.clients.PTTL(cache.ctx, "jitter-sliding").Val(); ttl <= 59*time.Second || ttl > 90*time.Second {
+		t.Errorf("Should have jittered the initial TTL, got %v", ttl)
+	}
+	cache.inMemCache.Delete("jitter-sliding")
+	val := ""
+	_, header, err := cache.get("jitter-sliding", &val)
+	if err != nil {
+		t.Fatalf("Failed to get entry: %v", err)
+	}
+	if header.window != time.Minute {
+		t.Errorf("Should slide by the TTL the key was written with, got %v", header.window)
+	}
+}
+
+func TestSyncCacheSetIfAbsent(t *testing.T) {
+	cache1 := NewSynchronizedCache(createRedisClient(), chanName, 10)
+	cache2 := NewSynchronizedCache(createRedisClient(), chanName, 10)
+	defer cache1.Close()
+	defer cache2.Close()
+	defer cache1.Delete("idempotency-key")
+
+	if written, err := cache1.SetIfAbsent("idempotency-key", "first", time.Minute); err != nil || !written {
+		t.Fatalf("Should write absent key, got %v", err)
+	}
+	val := ""
+	cache2.Get("idempotency-key", &val)
+
+	if written, err := cache2.SetIfAbsent("idempotency-key", "second", time.Minute); err != nil || written {
+		t.Errorf("Should not write existing key, got %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	// Nothing was published, so the first instance keeps its entry.
+	if info, ok := cache1.Inspect("idempotency-key"); !ok || info.Stale {
+		t.Errorf("Should not invalidate other instances")
+	}
+	for _, cache := range []*synchronizedCache{cache1, cache2} {
+		if err := cache.Get("idempotency-key", &val); err != nil || val != "first" {
+			t.Errorf("Should keep the first value, got %v", val)
+		}
+	}
+}
+
+func TestSyncCacheSetIfPresent(t *testing.T) {
+	cache1 := NewSynchronizedCache(createRedisClient(), chanName, 10)
+	cache2 := NewSynchronizedCache(createRedisClient(), chanName, 10)
+	defer cache1.Close()
+	defer cache2.Close()
+	defer cache1.Delete("present-key")
+
+	if written, err := cache1.SetIfPresent("present-key", "v1", time.Minute); err != nil || written {
+		t.Errorf("Should not write absent key, got %v", err)
+	}
+	val := ""
+	if err := cache2.Get("present-key", &val); err != ErrCacheMiss {
+		t.Errorf("Should not have written the key, got %v", err)
+	}
+
+	cache1.Set("present-key", "v1", time.Minute)
+	cache2.Get("present-key", &val)
+	if written, err := cache1.SetIfPresent("present-key", "v2", time.Minute); err != nil || !written {
+		t.Fatalf("Should write existing key, got %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for _, cache := range []*synchronizedCache{cache1, cache2} {
+		if err := cache.Get("present-key", &val); err != nil || val != "v2" {
+			t.Errorf("Should read the new value, got %v", val)
+		}
+	}
+}
+
+func TestSyncCacheGetAndSet(t *testing.T) {
+	cache1 := NewSynchronizedCache(createRedisClient(), chanName, 10)
+	cache2 := NewSynchronizedCache(createRedisClient(), chanName, 10)
+	defer cache1.Close()
+	defer cache2.Close()
+	defer cache1.Delete("counter")
+
+	old := ""
+	if existed, err := cache1.GetAndSet("counter", "v1", time.Minute, &old); err != nil || existed {
+		t.Errorf("Should report missing previous value, got %v", err)
+	}
+	if existed, err := cache2.GetAndSet("counter", "v2", time.Minute, &old, WithSlidingExpiration()); err != nil || !existed || old != "v1" {
+		t.Errorf("Should return previous value, got %v", old)
+	}
+	if existed, err := cache1.GetAndSet("counter", "v3", time.Minute, &old); err != nil || !existed || old != "v2" {
+		t.Errorf("Should return previous sliding value, got %v", old)
+	}
+	time.Sleep(100 * time.Millisecond)
+	val := ""
+	for _, cache := range []*synchronizedCache{cache1, cache2} {
+		if err := cache.Get("counter", &val); err != nil || val != "v3" {
+			t.Errorf("Should read the new value, got %v", val)
+		}
+	}
+}
+
+func TestSyncCacheCompareAndSet(t *testing.T) {
+	cache1 := NewSynchronizedCache(createRedisClient(), chanName, 10, WithVersioning())
+	cache2 := NewSynchronizedCache(createRedisClient(), chanName, 10, WithVersioning())
+	// Writes of this instance aren't notified to the others.
+	cache3 := NewSynchronizedCache(createRedisClient(), "other-channel", 10, WithVersioning())
+	defer cache1.Close()
+	defer cache2.Close()
+	defer cache3.Close()
+	defer cache1.Delete("versioned")
+
+	if version, err := cache1.CompareAndSet("versioned", 0, "v1", time.Minute); err != nil || version != 1 {
+		t.Fatalf("Should create missing key with version 1, got %v and %v", version, err)
+	}
+	if _, err := cache1.CompareAndSet("versioned", 0, "v1", time.Minute); err != ErrVersionConflict {
+		t.Errorf("Should not create existing key, got %v", err)
+	}
+
+	val := ""
+	if version, err := cache2.GetVersioned("versioned", &val); err != nil || version != 1 || val != "v1" {
+		t.Errorf("Should return version 1, got %v and %v", version, err)
+	}
+	cache1.Set("versioned", "v2", time.Minute)
+	if _, err := cache2.CompareAndSet("versioned", 1, "v3", time.Minute); err != ErrVersionConflict {
+		t.Errorf("Should not write key written since, got %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if version, _ := cache2.GetVersioned("versioned", &val); version != 2 || val != "v2" {
+		t.Errorf("Should return version 2, got %v", version)
+	}
+	if version, err := cache2.CompareAndSet("versioned", 2, "v3", time.Minute); err != nil || version != 3 {
+		t.Errorf("Should write key with version 3, got %v and %v", version, err)
+	}
+
+	// The first instance misses the notification of a write.
+	time.Sleep(100 * time.Millisecond)
+	cache1.GetVersioned("versioned", &val)
+	cache3.Set("versioned", "v4", time.Minute)
+	version, _ := cache1.GetVersioned("versioned", &val)
+	if _, err := cache1.CompareAndSet("versioned", version, "v5", time.Minute); err != ErrVersionConflict {
+		t.Errorf("Should not write key with a stale version, got %v", err)
+	}
+	if version, _ := cache1.GetVersioned("versioned", &val); version != 4 || val != "v4" {
+		t.Errorf("Should read the key again from redis after a conflict, got %v", version)
+	}
+}
+
+func TestSyncCacheCompareAndSetUnversionedValues(t *testing.T) {
+	cache := NewSynchronizedCache(createRedisClient(), chanName, 10, WithVersioning())
+	unversioned := NewSynchronizedCache(createRedisClient(), chanName, 10)
+	defer cache.Close()
+	defer unversioned.Close()
+	defer cache.Delete("unversioned")
+
+	if _, err := unversioned.CompareAndSet("unversioned", 0, "v1", time.Minute); err != ErrNotVersioned {
+		t.Errorf("Should fail without versioning, got %v", err)
+	}
+	unversioned.Set("unversioned", "v1", time.Minute)
+	if raw := cache.clients.Get(cache.ctx, "unversioned").Val(); raw != "v1" {
+		t.Errorf("Should have stored value without header, got %q", raw)
+	}
+
+	val := ""
+	if version, err := cache.GetVersioned("unversioned", &val); err != nil || version != 0 || val != "v1" {
+		t.Errorf("Should read value without header as version 0, got %v and %v", version, err)
+	}
+	if _, err := cache.CompareAndSet("unversioned", 0, "v2", time.Minute); err != ErrVersionConflict {
+		t.Errorf("Should not create existing key, got %v", err)
+	}
+}
+
+func TestSyncCacheHeaderLikeValuesWithoutVersioning(t *testing.T) {
+	cache := NewSynchronizedCache(createRedisClient(), chanName, 10)
+	versioned := NewSynchronizedCache(createRedisClient(), chanName, 10, WithVersioning())
+	defer cache.Close()
+	defer versioned.Close()
+	defer cache.Delete("header-like")
+
+	// Looks like a versioned header, with a wrong checksum.
+	corrupted := withVersionedHeader(valueHeader{version: 1}, []byte("v1"))
+	corrupted[21] ^= 0xFF
+	for _, value := range [][]byte{
+		append([]byte{0xC1, 0x81}, make([]byte, 20)...),
+		corrupted,
+	} {
+		cache.Set("header-like", value, time.Minute)
+		cache.inMemCache.Delete("header-like")
+		var val []byte
+		if err := cache.Get("header-like", &val); err != nil || !bytes.Equal(val, value) {
+			t.Errorf("Should read the value as is, got %v and %v", val, err)
+		}
+		if cache.clients.Exists(cache.ctx, "header-like").Val() != 1 {
+			t.Errorf("Should not have deleted the value")
+		}
+	}
+
+	// Versioned caches don't take the value for a versioned one.
+	if version, err := versioned.CompareAndSet("header-like", 1, "v2", time.Minute); err != ErrVersionConflict {
+		t.Errorf("Should not write key with a corrupted version, got %v and %v", version, err)
+	}
+}
+
+func TestSyncCacheCompareAndSetLargeVersions(t *testing.T) {
+	cache := NewSynchronizedCache(createRedisClient(), chanName, 10, WithVersioning())
+	defer cache.Close()
+	defer cache.Delete("large-version")
+
+	// Lua numbers can't tell these versions apart.
+	version := uint64(1<<53 + 1)
+	cache.clients.Set(cache.ctx, "large-version", withVersionedHeader(valueHeader{version: version}, []byte("v1")), time.Minute)
+	if _, err := cache.CompareAndSet("large-version", version-1, "v2", time.Minute); err != ErrVersionConflict {
+		t.Errorf("Should not write key with another version, got %v", err)
+	}
+	if newVersion, err := cache.CompareAndSet("large-version", version, "v2", time.Minute); err != nil || newVersion != version+1 {
+		t.Errorf("Should write key with version %d, got %v and %v", version+1, newVersion, err)
+	}
+}
+
+func TestSyncCacheCompareAndSetConcurrently(t *testing.T) {
+	caches := []*synchronizedCache{
+		NewSynchronizedCache(createRedisClient(), chanName, 10, WithVersioning()),
+		NewSynchronizedCache(createRedisClient(), chanName, 10, WithVersioning()),
+	}
+	defer caches[0].Delete("counter")
+
+	var wg sync.WaitGroup
+	for _, cache := range caches {
+		defer cache.Close()
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(cache *synchronizedCache) {
+				defer wg.Done()
+				for n := 0; n < 10; {
+					counter := 0
+					version, err := cache.GetVersioned("counter", &counter)
+					if err != nil && err != ErrCacheMiss {
+						t.Errorf("Failed to read counter: %v", err)
+						return
+					}
+					if _, err := cache.CompareAndSet("counter", version, counter+1, time.Minute); err == nil {
+						n++
+					} else if err != ErrVersionConflict {
+						t.Errorf("Failed to write counter: %v", err)
+						return
+					}
+				}
+			}(cache)
+		}
+	}
+	wg.Wait()
+	// Let the last update notification invalidate the in-memory entry.
+	time.Sleep(100 * time.Millisecond)
+
+	counter := 0
+	if version, err := caches[0].GetVersioned("counter", &counter); err != nil || counter != 80 || version != 80 {
+		t.Errorf("Should have incremented counter 80 times, got %d at version %d", counter, version)
+	}
+}
+
 func TestSyncCacheSetWithComplexType(t *testing.T) {
 	cache := NewSynchronizedCache(createRedisClient(), chanName, 10)
 	if cache == nil {
@@ -218,7 +910,7 @@ func TestSyncCacheSetWithComplexType(t *testing.T) {
 		println(err.Error())
 		t.Errorf("Failed to add entry")
 	}
-	if cache.inMemCache.numEntries.Load() != 1 {
+	if cache.inMemCache.Len() != 1 {
 		t.Errorf("Failed to add entry")
 	}
 	if _, ok := cache.inMemCache.Get("k1"); !ok {
@@ -272,7 +964,7 @@ func TestSyncCacheSetWithSliceValue(t *testing.T) {
 		println(err.Error())
 		t.Errorf("Failed to add entry")
 	}
-	if cache.inMemCache.numEntries.Load() != 1 {
+	if cache.inMemCache.Len() != 1 {
 		t.Errorf("Failed to add entry")
 	}
 	if _, ok := cache.inMemCache.Get("k1"); !ok {
@@ -323,7 +1015,7 @@ func TestSyncCacheSetWithMapValue(t *testing.T) {
 		println(err.Error())
 		t.Errorf("Failed to add entry")
 	}
-	if cache.inMemCache.numEntries.Load() != 1 {
+	if cache.inMemCache.Len() != 1 {
 		t.Errorf("Failed to add entry")
 	}
 	if _, ok := cache.inMemCache.Get("k1"); !ok {
@@ -366,7 +1058,7 @@ func TestSyncCacheSetWithNilValue(t *testing.T) {
 		println(err.Error())
 		t.Errorf("Failed to add entry")
 	}
-	if cache.inMemCache.numEntries.Load() != 1 {
+	if cache.inMemCache.Len() != 1 {
 		t.Errorf("Failed to add entry")
 	}
 	if _, ok := cache.inMemCache.Get("k1"); !ok {
@@ -409,7 +1101,7 @@ func TestSyncCacheSetWithEmptyStringValue(t *testing.T) {
 		println(err.Error())
 		t.Errorf("Failed to add entry")
 	}
-	if cache.inMemCache.numEntries.Load() != 1 {
+	if cache.inMemCache.Len() != 1 {
 		t.Errorf("Failed to add entry")
 	}
 	if _, ok := cache.inMemCache.Get("k1"); !ok {
@@ -452,7 +1144,7 @@ func TestSyncCacheSetWithEmptyByteSliceValue(t *testing.T) {
 		println(err.Error())
 		t.Errorf("Failed to add entry")
 	}
-	if cache.inMemCache.numEntries.Load() != 1 {
+	if cache.inMemCache.Len() != 1 {
 		t.Errorf("Failed to add entry")
 	}
 	if _, ok := cache.inMemCache.Get("k1"); !ok {
@@ -495,7 +1187,7 @@ func TestSyncCacheSetWithSliceOfStructsValue(t *testing.T) {
 		println(err.Error())
 		t.Errorf("Failed to add entry")
 	}
-	if cache.inMemCache.numEntries.Load() != 1 {
+	if cache.inMemCache.Len() != 1 {
 		t.Errorf("Failed to add entry")
 	}
 	if _, ok := cache.inMemCache.Get("k1"); !ok {
@@ -533,7 +1225,7 @@ func TestSyncCacheSetWithMapOfStructsValue(t *testing.T) {
 		println(err.Error())
 		t.Errorf("Failed to add entry")
 	}
-	if cache.inMemCache.numEntries.Load() != 1 {
+	if cache.inMemCache.Len() != 1 {
 		t.Errorf("Failed to add entry")
 	}
 	if _, ok := cache.inMemCache.Get("k1"); !ok {
@@ -571,7 +1263,7 @@ func TestSyncCacheSetWithSliceOfStructsPointersValue(t *testing.T) {
 		println(err.Error())
 		t.Errorf("Failed to add entry")
 	}
-	if cache.inMemCache.numEntries.Load() != 1 {
+	if cache.inMemCache.Len() != 1 {
 		t.Errorf("Failed to add entry")
 	}
 	if _, ok := cache.inMemCache.Get("k1"); !ok {
@@ -609,7 +1301,7 @@ func TestSyncCacheSetWithMapOfStructsPointersValue(t *testing.T) {
 		println(err.Error())
 		t.Errorf("Failed to add entry")
 	}
-	if cache.inMemCache.numEntries.Load() != 1 {
+	if cache.inMemCache.Len() != 1 {
 		t.Errorf("Failed to add entry")
 	}
 	if _, ok := cache.inMemCache.Get("k1"); !ok {
@@ -642,12 +1334,12 @@ func TestSyncCacheDelete(t *testing.T) {
 		t.Errorf("Failed to create sync cache")
 	}
 	cache.Set("k1", "v1", 0)
-	if cache.inMemCache.numEntries.Load() != 1 {
+	if cache.inMemCache.Len() != 1 {
 		t.Errorf("Failed to add entry")
 	}
 
 	cache.Delete("k1")
-	if cache.inMemCache.numEntries.Load() != 0 {
+	if cache.inMemCache.Len() != 0 {
 		t.Errorf("Failed to delete entry")
 	}
 
@@ -658,3 +1350,127 @@ func TestSyncCacheDelete(t *testing.T) {
 	}
 	cleanup(cache.clients)
 }
+
+func TestSyncCacheWithNamespaceCodec(t *testing.T) {
+	cache := NewSynchronizedCache(createRedisClient(), chanName, 10, WithNamespaceCodec("json:", JSONCodec{}))
+	if cache == nil {
+		t.Errorf("Failed to create sync cache")
+	}
+
+	if err := cache.Set("json:k1", testStruct{Name: "v1", Age: 22}, 0); err != nil {
+		t.Errorf("Failed to add entry")
+	}
+
+	raw, err := cache.clients.Get(cache.ctx, "json:k1").Result()
+	if err != nil {
+		t.Errorf("Failed to read raw entry from redis")
+	}
+	if raw != `{"Name":"v1","Age":22}` {
+		t.Errorf("Should have stored entry as JSON, got %s", raw)
+	}
+
+	cache.inMemCache.Delete("json:k1")
+	var val testStruct
+	if err := cache.Get("json:k1", &val); err != nil {
+		t.Errorf("Failed to get entry")
+	}
+	if val.Name != "v1" || val.Age != 22 {
+		t.Errorf("Failed to get entry")
+	}
+	cleanup(cache.clients)
+}
+
+func TestSyncCacheWithEncryption(t *testing.T) {
+	cache := NewSynchronizedCache(createRedisClient(), chanName, 10, WithEncryption(EncryptionKey{ID: 1, Key: make([]byte, 32)}))
+	if cache == nil {
+		t.Errorf("Failed to create sync cache")
+	}
+
+	if err := cache.Set("k1", "secret", 0); err != nil {
+		t.Errorf("Failed to add entry")
+	}
+
+	raw, err := cache.clients.Get(cache.ctx, "k1").Result()
+	if err != nil {
+		t.Errorf("Failed to read raw entry from redis")
+	}
+	if raw == "secret" {
+		t.Errorf("Should have stored encrypted entry")
+	}
+
+	cache.inMemCache.Delete("k1")
+	val := ""
+	if err := cache.Get("k1", &val); err != nil {
+		t.Errorf("Failed to get entry")
+	}
+	if val != "secret" {
+		t.Errorf("Failed to get entry")
+	}
+	cleanup(cache.clients)
+}
+
+func TestSyncCacheWithHeaderLikeValues(t *testing.T) {
+	caches := []*synchronizedCache{
+		NewSynchronizedCache(createRedisClient(), chanName, 10),
+		NewSynchronizedCache(createRedisClient(), chanName, 10, WithEncryption(EncryptionKey{ID: 0xC1800000, Key: make([]byte, 32)})),
+	}
+	defer caches[0].Delete("header-like")
+
+	value := []byte{0xC1, 0x80, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}
+	for i, cache := range caches {
+		defer cache.Close()
+		for j := 0; j < 10; j++ {
+			if err := cache.Set("header-like", value, time.Minute); err != nil {
+				t.Fatalf("Failed to add entry: %v", err)
+			}
+			cache.inMemCache.Delete("header-like")
+			var val []byte
+			if err := cache.Get("header-like", &val); err != nil || !bytes.Equal(val, value) {
+				t.Errorf("Cache %d: should read the value as is, got %v and %v", i, val, err)
+			}
+		}
+	}
+}
+
+func TestSyncCacheWithInvalidEncryptionKey(t *testing.T) {
+	for _, keys := range [][]EncryptionKey{
+		{{ID: 1, Key: []byte("short")}},
+		{testKey1, {ID: testKey1.ID, Key: testKey2.Key}},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Should have panicked with encryption keys %v", keys)
+				}
+			}()
+			NewSynchronizedCache(createRedisClient(), chanName, 10, WithEncryption(keys[0], keys[1:]...))
+		}()
+	}
+}
+
+func TestSyncCacheWithCorruptedValue(t *testing.T) {
+	cache := NewSynchronizedCache(createRedisClient(), chanName, 10, WithChecksum(CRC32CChecksum))
+	if cache == nil {
+		t.Errorf("Failed to create sync cache")
+	}
+
+	if err := cache.Set("k1", testStruct{Name: "v1", Age: 22}, 0); err != nil {
+		t.Errorf("Failed to add entry")
+	}
+	cache.inMemCache.Delete("k1")
+	if err := cache.clients.SetRange(cache.ctx, "k1", envelopeHeaderSize, "x").Err(); err != nil {
+		t.Errorf("Failed to corrupt entry")
+	}
+
+	var val testStruct
+	if err := cache.Get("k1", &val); err != ErrCacheMiss {
+		t.Errorf("Should have treated corrupted entry as a miss, got %v", err)
+	}
+	if cache.clients.Exists(cache.ctx, "k1").Val() != 0 {
+		t.Errorf("Should have deleted corrupted entry")
+	}
+	if cache.Stats().CorruptValues != 1 {
+		t.Errorf("Should have counted corrupted entry")
+	}
+	cleanup(cache.clients)
+}
@@ -0,0 +1,171 @@
+package hypercache
+
+const (
+	tinyLFUWindow = iota
+	tinyLFUProbation
+	tinyLFUProtected
+)
+
+type tinyLFUEntry struct {
+	node    *dlListNode[string]
+	segment int
+}
+
+/*
+ * tinyLFUPolicy implements W-TinyLFU. New entries go to a small LRU window,
+ * and entries pushed out of the window move to a segmented LRU holding the
+ * rest of the cache. Entries accessed while in its probation segment are
+ * promoted to its protected segment.
+ *
+ * When the cache is full, the entry about to leave the window competes with
+ * the probation victim, and the one with the lowest estimated frequency is
+ * evicted. One-off accesses such as scans therefore stay in the window and
+ * don't flush frequently used entries.
+ */
+type tinyLFUPolicy struct {
+	sketch  *countMinSketch
+	entries map[string]*tinyLFUEntry
+	// Segments of the cache, sorted by last access time.
+	window, probation, protected *dlList[string]
+	// Number of entries in each segment.
+	windowLen, probationLen, protectedLen int64
+	// Maximum number of entries in the window and protected segments.
+	maxWindow, maxProtected int64
+}
+
+// NewTinyLFUPolicy creates a W-TinyLFU eviction policy, which keeps
+// frequently used entries when the cache is hit by one-off accesses.
+func NewTinyLFUPolicy(capacity int64) EvictionPolicy {
+	return newTinyLFUPolicy(capacity, randomSeed())
+}
+
+// newTinyLFUPolicy creates a W-TinyLFU eviction policy whose sketch hashes
+// keys with the given seed.
+func newTinyLFUPolicy(capacity int64, seed uint64) *tinyLFUPolicy {
+	p := &tinyLFUPolicy{
+		sketch:    newCountMinSketch(capacity, seed),
+		entries:   map[string]*tinyLFUEntry{},
+		window:    newDLList[string](),
+		probation: newDLList[string](),
+		protected: newDLList[string](),
+	}
+	p.setSegmentSizes(capacity)
+	return p
+}
+
+func (p *tinyLFUPolicy) setSegmentSizes(capacity int64) {
+	// The window holds 1% of the entries, and the protected segment 80%
+	// of the rest.
+	p.maxWindow = capacity / 100
+	if p.maxWindow < 1 {
+		p.maxWindow = 1
+	}
+	p.maxProtected = (capacity - p.maxWindow) * 8 / 10
+}
+
+// Resize updates the segment sizes. Segments larger than their new size
+// shrink as entries are added and accessed. The sketch only grows, keeping
+// the frequencies seen so far when the cache shrinks.
+func (p *tinyLFUPolicy) Resize(capacity int64) {
+	p.setSegmentSizes(capacity)
+	if nextPowerOfTwo(uint64(capacity)) > p.sketch.mask+1 {
+		p.sketch = newCountMinSketch(capacity, p.sketch.seed)
+	}
+}
+
+func (p *tinyLFUPolicy) ShouldAddEntry(key string, value interface{}) bool {
+	// Every entry is admitted to the window, the frequency check happens
+	// when choosing the victim.
+	return true
+}
+
+func (p *tinyLFUPolicy) ShouldKeepEntry(key string, value interface{}) bool {
+	p.sketch.increment(key)
+	entry, ok := p.entries[key]
+	if !ok {
+		return true
+	}
+	switch entry.segment {
+	case tinyLFUWindow:
+		p.window.moveToFront(entry.node)
+	case tinyLFUProbation:
+		// Promote the entry to the protected segment.
+		p.probation.remove(entry.node)
+		p.probationLen--
+		entry.node = p.protected.pushFront(key)
+		entry.segment = tinyLFUProtected
+		p.protectedLen++
+		// Demote the least recently used protected entry if needed.
+		if p.protectedLen > p.maxProtected {
+			demoted := p.protected.popBack()
+			p.protectedLen--
+			demotedEntry := p.entries[demoted]
+			demotedEntry.node = p.probation.pushFront(demoted)
+			demotedEntry.segment = tinyLFUProbation
+			p.probationLen++
+		}
+	case tinyLFUProtected:
+		p.protected.moveToFront(entry.node)
+	}
+	return true
+}
+
+func (p *tinyLFUPolicy) EntryAdded(key string, value interface{}) {
+	p.sketch.increment(key)
+	p.entries[key] = &tinyLFUEntry{
+		node:    p.window.pushFront(key),
+		segment: tinyLFUWindow,
+	}
+	p.windowLen++
+	// Move the entries pushed out of the window to the probation segment.
+	for p.windowLen > p.maxWindow {
+		candidate := p.window.popBack()
+		p.windowLen--
+		entry := p.entries[candidate]
+		entry.node = p.probation.pushFront(candidate)
+		entry.segment = tinyLFUProbation
+		p.probationLen++
+	}
+}
+
+func (p *tinyLFUPolicy) EntryRemoved(key string) {
+	entry, ok := p.entries[key]
+	if !ok {
+		return
+	}
+	switch entry.segment {
+	case tinyLFUWindow:
+		p.window.remove(entry.node)
+		p.windowLen--
+	case tinyLFUProbation:
+		p.probation.remove(entry.node)
+		p.probationLen--
+	case tinyLFUProtected:
+		p.protected.remove(entry.node)
+		p.protectedLen--
+	}
+	delete(p.entries, key)
+}
+
+func (p *tinyLFUPolicy) Victim() (string, bool) {
+	victim := p.probation.back()
+	if victim == nil {
+		victim = p.protected.back()
+	}
+	candidate := p.window.back()
+	// The window candidate only leaves the window once it is full.
+	if candidate == nil || p.windowLen < p.maxWindow {
+		if victim == nil {
+			return "", false
+		}
+		return victim.value, true
+	}
+	if victim == nil {
+		return candidate.value, true
+	}
+	// Keep whichever of the candidate and the victim is used more often.
+	if p.sketch.estimate(candidate.value) > p.sketch.estimate(victim.value) {
+		return victim.value, true
+	}
+	return candidate.value, true
+}
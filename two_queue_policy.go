@@ -0,0 +1,86 @@
+package hypercache
+
+/*
+ * twoQueuePolicy implements the full 2Q algorithm. New entries go to the
+ * in FIFO queue, and keys evicted from it are remembered in the out ghost
+ * queue. Only entries added again while remembered there are considered hot,
+ * and go to the main LRU list. Entries accessed once, as in a scan, never
+ * reach the main list.
+ */
+type twoQueuePolicy struct {
+	in, out, main *keyList
+	// Maximum number of keys in the in and out queues.
+	maxIn, maxOut int64
+	// Key returned by the last call to Victim.
+	victim string
+}
+
+// New2QPolicy creates a 2Q eviction policy, which resists scans by keeping
+// entries in the main list only once they were accessed again after
+// leaving the in queue.
+func New2QPolicy(capacity int64) EvictionPolicy {
+	p := &twoQueuePolicy{
+		in:   newKeyList(),
+		out:  newKeyList(),
+		main: newKeyList(),
+	}
+	p.Resize(capacity)
+	return p
+}
+
+func (p *twoQueuePolicy) Resize(capacity int64) {
+	// Sizes recommended by the 2Q paper.
+	p.maxIn = capacity / 4
+	p.maxOut = capacity / 2
+	if p.maxIn < 1 {
+		p.maxIn = 1
+	}
+	if p.maxOut < 1 {
+		p.maxOut = 1
+	}
+}
+
+func (p *twoQueuePolicy) ShouldAddEntry(key string, value interface{}) bool {
+	return true
+}
+
+func (p *twoQueuePolicy) ShouldKeepEntry(key string, value interface{}) bool {
+	// Accesses in the in queue are considered correlated and ignored.
+	if p.main.contains(key) {
+		p.main.moveToFront(key)
+	}
+	return true
+}
+
+func (p *twoQueuePolicy) EntryAdded(key string, value interface{}) {
+	if p.out.remove(key) {
+		p.main.pushFront(key)
+	} else {
+		p.in.pushFront(key)
+	}
+	// The out queue is only trimmed once the key was looked up in it, as
+	// adding an entry to a full cache first evicts another one.
+	for p.out.len() > p.maxOut {
+		p.out.popBack()
+	}
+}
+
+func (p *twoQueuePolicy) EntryRemoved(key string) {
+	evicted := key == p.victim
+	p.victim = ""
+	if p.in.remove(key) && evicted {
+		p.out.pushFront(key)
+		return
+	}
+	p.main.remove(key)
+}
+
+func (p *twoQueuePolicy) Victim() (string, bool) {
+	var ok bool
+	if p.in.len() > p.maxIn || p.main.len() == 0 {
+		p.victim, ok = p.in.back()
+	} else {
+		p.victim, ok = p.main.back()
+	}
+	return p.victim, ok
+}
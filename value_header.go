@@ -0,0 +1,171 @@
+package hypercache
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+/*
+ * Values written with a sliding expiration are prefixed in redis with the
+ * length of their window, so that every instance reading them knows how far
+ * to extend their TTL:
+ *
+ *	+-------+--------+-------------------+----------+
+ *	| magic | marker | window (ms, BE64) | checksum |
+ *	+-------+--------+-------------------+----------+
+ *
+ * With WithVersioning, every value is instead prefixed with a header also
+ * holding its version, bumped on every write:
+ *
+ *	+-------+--------+-------------------+----------------+----------+
+ *	| magic | marker | window (ms, BE64) | version (BE64) | checksum |
+ *	+-------+--------+-------------------+----------------+----------+
+ *
+ * The magic is 3 bytes long and differs from the one of envelopes, and the
+ * checksum covers the rest of the header, as it isn't covered by the
+ * checksum of the value. Other values are stored as is, and read as version
+ * 0 without window, unless they happen to start with a valid header. The
+ * serialized value follows the header.
+ *
+ * Versions are bumped by the scripts writing values, which build the header
+ * with the Lua functions below. They handle versions as 8-byte strings, as
+ * Lua numbers lose precision above 2^53.
+ */
+const (
+	valueHeaderMagic           = "\xC1HV"
+	slidingHeaderMarker   byte = 0x80
+	slidingHeaderSize          = 14
+	versionedHeaderMarker byte = 0x81
+	versionedHeaderSize        = 22
+)
+
+var (
+	valueHeaderLua = `
+		local noVersion = string.rep("\0", 8)
+		local versionedHeaderPrefix = string.char(193, 72, 86, 129)
+
+		local function headerChecksum(s)
+			local sum1, sum2 = 0, 0
+			for i = 1, #s do
+				sum1 = (sum1 + string.byte(s, i)) % 256
+				sum2 = (sum2 + sum1) % 256
+			end
+			return string.char(sum2, sum1)
+		end
+
+		local function headerVersion(value)
+			if not value or #value < 22 or string.sub(value, 1, 4) ~= versionedHeaderPrefix then
+				return noVersion
+			end
+			if string.sub(value, 21, 22) ~= headerChecksum(string.sub(value, 1, 20)) then
+				return noVersion
+			end
+			return string.sub(value, 13, 20)
+		end
+
+		local function nextVersion(version)
+			local bytes = {string.byte(version, 1, 8)}
+			for i = 8, 1, -1 do
+				if bytes[i] < 255 then
+					bytes[i] = bytes[i] + 1
+					break
+				end
+				bytes[i] = 0
+			end
+			return string.char(unpack(bytes))
+		end
+
+		local function withHeader(window, version, value)
+			local header = versionedHeaderPrefix .. window .. version
+			return header .. headerChecksum(header) .. value
+		end
+	`
+)
+
+type valueHeader struct {
+	// Sliding expiration window of the key, or 0 if it has a fixed TTL.
+	window time.Duration
+	// Number of times the key was written with versioning enabled, or 0
+	// if it wasn't.
+	version uint64
+}
+
+// uint64Bytes returns the big endian encoding of n, which is how versions
+// and windows are passed to the scripts.
+func uint64Bytes(n uint64) []byte {
+	buff := make([]byte, 8)
+	binary.BigEndian.PutUint64(buff, n)
+	return buff
+}
+
+// withSlidingHeader prefixes the serialized value with its sliding window.
+func withSlidingHeader(window time.Duration, value []byte) []byte {
+	buff := make([]byte, slidingHeaderSize, slidingHeaderSize+len(value))
+	copy(buff, valueHeaderMagic)
+	buff[3] = slidingHeaderMarker
+	binary.BigEndian.PutUint64(buff[4:12], uint64(ttlMilliseconds(window)))
+	binary.BigEndian.PutUint16(buff[12:14], headerChecksum(buff[:12]))
+	return append(buff, value...)
+}
+
+// withVersionedHeader prefixes the serialized value with the versioned
+// header.
+func withVersionedHeader(h valueHeader, value []byte) []byte {
+	buff := make([]byte, versionedHeaderSize, versionedHeaderSize+len(value))
+	copy(buff, valueHeaderMagic)
+	buff[3] = versionedHeaderMarker
+	binary.BigEndian.PutUint64(buff[4:12], uint64(ttlMilliseconds(h.window)))
+	binary.BigEndian.PutUint64(buff[12:20], h.version)
+	binary.BigEndian.PutUint16(buff[20:22], headerChecksum(buff[:20]))
+	return append(buff, value...)
+}
+
+// parseValueHeader splits a value read from redis into its header and the
+// serialized value. It returns ErrChecksumMismatch if the header is corrupted.
+func parseValueHeader(buff []byte) (valueHeader, []byte, error) {
+	size := 0
+	if len(buff) > len(valueHeaderMagic) && string(buff[:len(valueHeaderMagic)]) == valueHeaderMagic {
+		switch buff[len(valueHeaderMagic)] {
+		case slidingHeaderMarker:
+			size = slidingHeaderSize
+		case versionedHeaderMarker:
+			size = versionedHeaderSize
+		}
+	}
+	if size == 0 || len(buff) < size {
+		return valueHeader{}, buff, nil
+	}
+	if binary.BigEndian.Uint16(buff[size-2:size]) != headerChecksum(buff[:size-2]) {
+		return valueHeader{}, nil, ErrChecksumMismatch
+	}
+	header := valueHeader{
+		window: time.Duration(binary.BigEndian.Uint64(buff[4:12])) * time.Millisecond,
+	}
+	if size == versionedHeaderSize {
+		header.version = binary.BigEndian.Uint64(buff[12:20])
+	}
+	return header, buff[size:], nil
+}
+
+// readValueHeader parses the header of a value like parseValueHeader. Caches
+// without versioning also store values as is, so a header failing its
+// checksum is taken as part of such a value there rather than corruption.
+func readValueHeader(buff []byte, versioning bool) (valueHeader, []byte, error) {
+	header, payload, err := parseValueHeader(buff)
+	if err == ErrChecksumMismatch && !versioning {
+		return valueHeader{}, buff, nil
+	}
+	return header, payload, err
+}
+
+// headerChecksum computes the checksum of value headers, which is simple
+// enough to be computed by the scripts. It's Fletcher-16 with sums modulo 256
+// rather than 255, so that any change of a single byte is detected.
+func headerChecksum(buff []byte) uint16 {
+	var sum1, sum2 uint8
+	for _, b := range buff {
+		sum1 += b
+		sum2 += sum1
+	}
+	return uint16(sum2)<<8 | uint16(sum1)
+}
@@ -0,0 +1,48 @@
+package hypercache
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestValueHeader(t *testing.T) {
+	value := []byte("value")
+	header, payload, err := parseValueHeader(withVersionedHeader(valueHeader{window: time.Minute, version: 42}, value))
+	if err != nil || header.window != time.Minute || header.version != 42 || !bytes.Equal(payload, value) {
+		t.Errorf("Failed to parse versioned header, got %v, %q and %v", header, payload, err)
+	}
+
+	header, payload, err = parseValueHeader(withSlidingHeader(time.Minute, value))
+	if err != nil || header.window != time.Minute || header.version != 0 || !bytes.Equal(payload, value) {
+		t.Errorf("Failed to parse sliding header, got %v, %q and %v", header, payload, err)
+	}
+
+	if header, payload, err := parseValueHeader(value); err != nil || header != (valueHeader{}) || !bytes.Equal(payload, value) {
+		t.Errorf("Should read values without header as version 0, got %v, %q and %v", header, payload, err)
+	}
+}
+
+func TestValueHeaderCorrupted(t *testing.T) {
+	for _, buff := range [][]byte{
+		withVersionedHeader(valueHeader{window: time.Minute, version: 42}, []byte("value")),
+		withSlidingHeader(time.Minute, []byte("value")),
+	} {
+		buff[8] ^= 0xFF
+		if _, _, err := parseValueHeader(buff); err != ErrChecksumMismatch {
+			t.Errorf("Should have failed with ErrChecksumMismatch, got %v", err)
+		}
+	}
+}
+
+func TestValueHeaderLookAlikes(t *testing.T) {
+	for _, value := range [][]byte{
+		{0xC1, 0x80, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+		append([]byte(envelopeMagic), make([]byte, 20)...),
+		[]byte(valueHeaderMagic),
+	} {
+		if header, payload, err := parseValueHeader(value); err != nil || header != (valueHeader{}) || !bytes.Equal(payload, value) {
+			t.Errorf("Should read %v as a value without header, got %v, %v and %v", value, header, payload, err)
+		}
+	}
+}